@@ -0,0 +1,32 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"os/exec"
+	"strings"
+)
+
+// ageEncrypt encrypts data to the age or SSH public keys in recipients,
+// for -key-recipient. It runs the age command, which must be installed, so
+// microca doesn't need the age library and its dependencies. Decrypting is
+// left to age too.
+func ageEncrypt(data []byte, recipients []string) ([]byte, error) {
+	path, err := exec.LookPath("age")
+	if err != nil {
+		return nil, fmt.Errorf("-key-recipient needs the age command (https://age-encryption.org): %s", err)
+	}
+	var args []string
+	for _, r := range recipients {
+		args = append(args, "-r", r)
+	}
+	var stdout, stderr bytes.Buffer
+	cmd := exec.Command(path, args...)
+	cmd.Stdin = bytes.NewReader(data)
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		return nil, fmt.Errorf("age: %s: %s", err, strings.TrimSpace(stderr.String()))
+	}
+	return stdout.Bytes(), nil
+}
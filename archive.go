@@ -0,0 +1,116 @@
+package main
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// leafArchive collects the files of issued certificates in a tar.gz or zip
+// archive for -archive, with the same layout and permissions they'd have on
+// disk.
+type leafArchive struct {
+	filename string
+	file     *os.File
+	gz       *gzip.Writer
+	tw       *tar.Writer
+	zw       *zip.Writer
+	dirs     map[string]bool
+}
+
+// createArchive creates filename, choosing the format from its extension.
+func createArchive(filename string) (*leafArchive, error) {
+	isZip := strings.HasSuffix(filename, ".zip")
+	if !isZip && !strings.HasSuffix(filename, ".tar.gz") && !strings.HasSuffix(filename, ".tgz") {
+		return nil, usageErrorf("-archive %s must end in .tar.gz, .tgz or .zip", filename)
+	}
+	file, err := createFile(filename, 0600)
+	if err != nil {
+		return nil, err
+	}
+	a := &leafArchive{filename: filename, file: file, dirs: map[string]bool{}}
+	if isZip {
+		a.zw = zip.NewWriter(file)
+	} else {
+		a.gz = gzip.NewWriter(file)
+		a.tw = tar.NewWriter(a.gz)
+	}
+	return a, nil
+}
+
+// add stores data as filename with permissions perm, preceded by entries
+// for the folders leading to it.
+func (a *leafArchive) add(filename string, perm os.FileMode, data []byte) error {
+	name := filepath.ToSlash(filepath.Clean(filename))
+	name = strings.TrimLeft(name, "/")
+	if name == ".." || strings.HasPrefix(name, "../") {
+		return fmt.Errorf("%s is outside the current directory and can't be stored in the archive", filename)
+	}
+	var dirs []string
+	for dir := path.Dir(name); dir != "." && dir != "/" && !a.dirs[dir]; dir = path.Dir(dir) {
+		dirs = append([]string{dir}, dirs...)
+	}
+	for _, dir := range dirs {
+		if err := a.entry(dir+"/", os.ModeDir|0700, nil); err != nil {
+			return err
+		}
+		a.dirs[dir] = true
+	}
+	return a.entry(name, perm, data)
+}
+
+func (a *leafArchive) entry(name string, mode os.FileMode, data []byte) error {
+	if a.zw != nil {
+		h := &zip.FileHeader{Name: name, Method: zip.Deflate, Modified: now()}
+		h.SetMode(mode)
+		w, err := a.zw.CreateHeader(h)
+		if err != nil {
+			return err
+		}
+		_, err = w.Write(data)
+		return err
+	}
+	h := &tar.Header{
+		Name:     name,
+		Mode:     int64(mode.Perm()),
+		Size:     int64(len(data)),
+		ModTime:  now(),
+		Typeflag: tar.TypeReg,
+	}
+	if mode.IsDir() {
+		h.Typeflag = tar.TypeDir
+	}
+	if err := a.tw.WriteHeader(h); err != nil {
+		return err
+	}
+	_, err := a.tw.Write(data)
+	return err
+}
+
+// close finishes the archive.
+func (a *leafArchive) close() error {
+	var closers []io.Closer
+	if a.zw != nil {
+		closers = []io.Closer{a.zw, a.file}
+	} else {
+		closers = []io.Closer{a.tw, a.gz, a.file}
+	}
+	for _, c := range closers {
+		if err := c.Close(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// abort closes and removes an archive left incomplete by a failure.
+func (a *leafArchive) abort() {
+	a.file.Close()
+	os.Remove(a.filename)
+}
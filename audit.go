@@ -0,0 +1,90 @@
+package main
+
+import (
+	"crypto/sha256"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/hex"
+	"encoding/json"
+	"os"
+	"os/user"
+	"time"
+)
+
+// auditEntry is the JSON line -audit-log appends for each certificate
+// issued.
+type auditEntry struct {
+	Time          time.Time `json:"time"`
+	Operator      string    `json:"operator"`
+	Serial        string    `json:"serial"`
+	Subject       string    `json:"subject"`
+	DNSNames      []string  `json:"dns_names,omitempty"`
+	IPAddresses   []string  `json:"ip_addresses,omitempty"`
+	KeyType       string    `json:"key_type"`
+	NotBefore     time.Time `json:"not_before"`
+	NotAfter      time.Time `json:"not_after"`
+	CAFingerprint string    `json:"ca_sha256"`
+}
+
+// operator returns who is issuing, for the audit log: $USER, or the name
+// of the current user if it isn't set.
+func operator() string {
+	if name := os.Getenv("USER"); name != "" {
+		return name
+	}
+	if u, err := user.Current(); err == nil {
+		return u.Username
+	}
+	return ""
+}
+
+// audit appends an entry for the certificate issued from template for
+// pubKey, with the additional unicodeDomains SANs of -idn-both, by the CA
+// certificate caDER to the -audit-log file. It's described from the
+// template since crypto/x509 can't parse every certificate microca can
+// issue. The line is written with a single O_APPEND write while holding an
+// exclusive lock on the file, so runs issuing at the same time don't
+// interleave their entries.
+func audit(template *x509.Certificate, pubKey interface{}, unicodeDomains []string, caDER []byte) error {
+	subject := template.Subject
+	if template.RawSubject != nil {
+		var seq pkix.RDNSequence
+		if _, err := asn1.Unmarshal(template.RawSubject, &seq); err != nil {
+			return err
+		}
+		subject = pkix.Name{}
+		subject.FillFromRDNSequence(&seq)
+	}
+	entry := auditEntry{
+		Time:      time.Now().UTC(),
+		Operator:  operator(),
+		Serial:    serialHex(template.SerialNumber),
+		Subject:   subject.String(),
+		KeyType:   keyDescription(pubKey),
+		NotBefore: template.NotBefore,
+		NotAfter:  template.NotAfter,
+	}
+	entry.DNSNames = append(append(entry.DNSNames, template.DNSNames...), unicodeDomains...)
+	for _, ip := range template.IPAddresses {
+		entry.IPAddresses = append(entry.IPAddresses, ip.String())
+	}
+	fp := sha256.Sum256(caDER)
+	entry.CAFingerprint = hex.EncodeToString(fp[:])
+	line, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+	f, err := os.OpenFile(auditLogPath, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	if err := lockFile(f); err != nil {
+		return err
+	}
+	if _, err := f.Write(append(line, '\n')); err != nil {
+		return err
+	}
+	return f.Close()
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"fmt"
+	"io"
+	"math/big"
+	"text/tabwriter"
+	"time"
+)
+
+// benchKeyTypes are the leaf key types -bench measures.
+var benchKeyTypes = []keyType{
+	{algorithm: "ecdsa", curve: "P256"},
+	{algorithm: "ecdsa", curve: "P384"},
+	{algorithm: "ed25519"},
+	{algorithm: "rsa", rsaBits: 2048},
+	{algorithm: "rsa", rsaBits: 4096},
+}
+
+// bench issues leaf certificates in memory, count of them per key type or,
+// if count is 0, as many as it can in duration, signed by a throwaway CA of
+// the key type chosen by the key flags. It reports the throughput and the
+// average time spent generating keys and signing. Nothing is written to disk.
+func bench(w io.Writer, duration time.Duration, count int) error {
+	caKT := flagKeyType()
+	if err := checkSigningKeyType(caKT); err != nil {
+		return err
+	}
+	caKey, err := generateKey(caKT)
+	if err != nil {
+		return err
+	}
+	caTemplate := &x509.Certificate{
+		Subject:               pkix.Name{CommonName: "microca bench"},
+		SerialNumber:          big.NewInt(1),
+		NotBefore:             now(),
+		NotAfter:              now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	caDER, err := x509.CreateCertificate(signingRandom(), caTemplate, caTemplate, publicKey(caKey), certSigner(caKey))
+	if err != nil {
+		return err
+	}
+	caCert, err := x509.ParseCertificate(caDER)
+	if err != nil {
+		return err
+	}
+
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintf(tw, "Leaf key (%s CA)\tCerts\tCerts/sec\tAvg keygen\tAvg sign\n", describeNewKey(caKT))
+	for _, kt := range benchKeyTypes {
+		var n int
+		var keygen, signing time.Duration
+		start := time.Now()
+		for n == 0 || (count == 0 && time.Since(start) < duration) || n < count {
+			t0 := time.Now()
+			key, err := generateKey(kt)
+			if err != nil {
+				return err
+			}
+			t1 := time.Now()
+			serial, err := randomSerial()
+			if err != nil {
+				return err
+			}
+			template := &x509.Certificate{
+				Subject:      pkix.Name{CommonName: "bench.example"},
+				DNSNames:     []string{"bench.example"},
+				SerialNumber: serial,
+				NotBefore:    now(),
+				NotAfter:     now().Add(time.Hour),
+				KeyUsage:     x509.KeyUsageDigitalSignature,
+				ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+			}
+			_, err = x509.CreateCertificate(signingRandom(), template, caCert, publicKey(key), certSigner(caKey))
+			if err != nil {
+				return err
+			}
+			keygen += t1.Sub(t0)
+			signing += time.Since(t1)
+			n++
+		}
+		elapsed := time.Since(start)
+		fmt.Fprintf(tw, "%s\t%d\t%.1f\t%s\t%s\n", describeNewKey(kt), n, float64(n)/elapsed.Seconds(),
+			(keygen / time.Duration(n)).Round(time.Microsecond), (signing / time.Duration(n)).Round(time.Microsecond))
+	}
+	return tw.Flush()
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+)
+
+// Extensions -clone-from doesn't copy verbatim: they describe the reference
+// certificate's own key, names or issuer, are regenerated by crypto/x509,
+// or are copied through template fields so flags can override them.
+var uncloned = []asn1.ObjectIdentifier{
+	{2, 5, 29, 14},              // subjectKeyIdentifier
+	{2, 5, 29, 15},              // keyUsage
+	{2, 5, 29, 17},              // subjectAltName
+	{2, 5, 29, 19},              // basicConstraints
+	{2, 5, 29, 35},              // authorityKeyIdentifier
+	{2, 5, 29, 37},              // extKeyUsage
+	{1, 3, 6, 1, 5, 5, 7, 1, 1}, // authorityInfoAccess
+	oidCTSCTList,
+	oidCTPoison,
+}
+
+// cloneExtensions copies the extensions of the reference certificate ref
+// into template, for -clone-from. Key usages and AIA URLs go through the
+// template's fields, the rest, such as policies, CRL distribution points
+// and private extensions, are copied as they are.
+func cloneExtensions(template, ref *x509.Certificate) {
+	template.KeyUsage = ref.KeyUsage
+	template.ExtKeyUsage = ref.ExtKeyUsage
+	template.UnknownExtKeyUsage = ref.UnknownExtKeyUsage
+	template.OCSPServer = ref.OCSPServer
+	if len(template.IssuingCertificateURL) == 0 {
+		template.IssuingCertificateURL = ref.IssuingCertificateURL
+	}
+next:
+	for _, ext := range ref.Extensions {
+		for _, oid := range uncloned {
+			if ext.Id.Equal(oid) {
+				continue next
+			}
+		}
+		template.ExtraExtensions = append(template.ExtraExtensions, ext)
+	}
+}
+
+// dedupExtensions drops all but the last of extensions with the same OID,
+// so extensions added by flags replace those copied by -clone-from.
+func dedupExtensions(exts []pkix.Extension) []pkix.Extension {
+	var out []pkix.Extension
+	for i, ext := range exts {
+		replaced := false
+		for _, later := range exts[i+1:] {
+			if later.Id.Equal(ext.Id) {
+				replaced = true
+				break
+			}
+		}
+		if !replaced {
+			out = append(out, ext)
+		}
+	}
+	return out
+}
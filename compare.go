@@ -0,0 +1,159 @@
+package main
+
+import (
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+)
+
+var keyUsageNames = []struct {
+	usage x509.KeyUsage
+	name  string
+}{
+	{x509.KeyUsageDigitalSignature, "digitalSignature"},
+	{x509.KeyUsageContentCommitment, "contentCommitment"},
+	{x509.KeyUsageKeyEncipherment, "keyEncipherment"},
+	{x509.KeyUsageDataEncipherment, "dataEncipherment"},
+	{x509.KeyUsageKeyAgreement, "keyAgreement"},
+	{x509.KeyUsageCertSign, "keyCertSign"},
+	{x509.KeyUsageCRLSign, "cRLSign"},
+	{x509.KeyUsageEncipherOnly, "encipherOnly"},
+	{x509.KeyUsageDecipherOnly, "decipherOnly"},
+}
+
+var extKeyUsageNames = map[x509.ExtKeyUsage]string{
+	x509.ExtKeyUsageAny:             "any",
+	x509.ExtKeyUsageServerAuth:      "serverAuth",
+	x509.ExtKeyUsageClientAuth:      "clientAuth",
+	x509.ExtKeyUsageCodeSigning:     "codeSigning",
+	x509.ExtKeyUsageEmailProtection: "emailProtection",
+	x509.ExtKeyUsageTimeStamping:    "timeStamping",
+	x509.ExtKeyUsageOCSPSigning:     "OCSPSigning",
+}
+
+// certField is a named, printable part of a certificate.
+type certField struct {
+	name  string
+	value string
+}
+
+func certFields(cert *x509.Certificate) []certField {
+	var usages []string
+	for _, u := range keyUsageNames {
+		if cert.KeyUsage&u.usage != 0 {
+			usages = append(usages, u.name)
+		}
+	}
+	var ekus []string
+	for _, u := range cert.ExtKeyUsage {
+		name, ok := extKeyUsageNames[u]
+		if !ok {
+			name = fmt.Sprintf("%d", u)
+		}
+		ekus = append(ekus, name)
+	}
+	for _, oid := range cert.UnknownExtKeyUsage {
+		ekus = append(ekus, oid.String())
+	}
+	var ips, uris, exts []string
+	for _, ip := range cert.IPAddresses {
+		ips = append(ips, ip.String())
+	}
+	for _, u := range cert.URIs {
+		uris = append(uris, u.String())
+	}
+	for _, e := range cert.Extensions {
+		ext := e.Id.String()
+		if e.Critical {
+			ext += " (critical)"
+		}
+		exts = append(exts, ext)
+	}
+	basic := "absent"
+	if cert.BasicConstraintsValid {
+		basic = fmt.Sprintf("CA:%t", cert.IsCA)
+		if cert.IsCA && (cert.MaxPathLen > 0 || cert.MaxPathLenZero) {
+			basic += fmt.Sprintf(", pathlen:%d", cert.MaxPathLen)
+		}
+	}
+	return []certField{
+		{"Subject", cert.Subject.String()},
+		{"Issuer", cert.Issuer.String()},
+		{"Serial", serialHex(cert.SerialNumber)},
+		{"Not before", cert.NotBefore.UTC().Format(time.RFC3339)},
+		{"Not after", cert.NotAfter.UTC().Format(time.RFC3339)},
+		{"DNS names", strings.Join(cert.DNSNames, ", ")},
+		{"IP addresses", strings.Join(ips, ", ")},
+		{"Email addresses", strings.Join(cert.EmailAddresses, ", ")},
+		{"URIs", strings.Join(uris, ", ")},
+		{"Public key", keyDescription(cert.PublicKey)},
+		{"Signature algorithm", cert.SignatureAlgorithm.String()},
+		{"Key usage", strings.Join(usages, ", ")},
+		{"Extended key usage", strings.Join(ekus, ", ")},
+		{"Basic constraints", basic},
+		{"Extensions", strings.Join(exts, ", ")},
+	}
+}
+
+// extensionValue describes the extension ext as printed by compareCerts:
+// its criticality and hex encoded value, or "absent" if ext is nil.
+func extensionValue(ext *pkix.Extension) string {
+	if ext == nil {
+		return "absent"
+	}
+	v := hex.EncodeToString(ext.Value)
+	if ext.Critical {
+		v = "critical " + v
+	}
+	return v
+}
+
+// extensionFields returns a field per extension OID found in a or b, in
+// the order they appear in a and then in b, so extensions are compared by
+// value and not only by presence.
+func extensionFields(a, b *x509.Certificate) (fa, fb []certField) {
+	find := func(cert *x509.Certificate, oid asn1.ObjectIdentifier) *pkix.Extension {
+		for i := range cert.Extensions {
+			if cert.Extensions[i].Id.Equal(oid) {
+				return &cert.Extensions[i]
+			}
+		}
+		return nil
+	}
+	seen := make(map[string]bool)
+	for _, ext := range append(append([]pkix.Extension(nil), a.Extensions...), b.Extensions...) {
+		name := "Extension " + ext.Id.String()
+		if seen[name] {
+			continue
+		}
+		seen[name] = true
+		fa = append(fa, certField{name, extensionValue(find(a, ext.Id))})
+		fb = append(fb, certField{name, extensionValue(find(b, ext.Id))})
+	}
+	return fa, fb
+}
+
+// compareCerts prints the fields of a and b, marking those that differ
+// with "!" and showing both values as a unified diff would. Extensions are
+// compared by value, one field per OID. It returns the number of differing
+// fields.
+func compareCerts(w io.Writer, a, b *x509.Certificate) int {
+	fa, fb := certFields(a), certFields(b)
+	ea, eb := extensionFields(a, b)
+	fa, fb = append(fa, ea...), append(fb, eb...)
+	differ := 0
+	for i := range fa {
+		if fa[i].value == fb[i].value {
+			fmt.Fprintf(w, "  %s: %s\n", fa[i].name, fa[i].value)
+			continue
+		}
+		differ++
+		fmt.Fprintf(w, "! %s:\n  - %s\n  + %s\n", fa[i].name, fa[i].value, fb[i].value)
+	}
+	return differ
+}
@@ -0,0 +1,137 @@
+package main
+
+import (
+	"bytes"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// Certificate Transparency (RFC 6962) for -ct-log: a precertificate is
+// submitted to a log, and the signed certificate timestamp (SCT) it returns
+// is embedded in the final certificate.
+
+var (
+	oidCTPoison  = asn1.ObjectIdentifier{1, 3, 6, 1, 4, 1, 11129, 2, 4, 3}
+	oidCTSCTList = asn1.ObjectIdentifier{1, 3, 6, 1, 4, 1, 11129, 2, 4, 2}
+)
+
+// addChainResponse is a log's response to add-pre-chain (RFC 6962, section
+// 4.1), with binary fields base64 encoded.
+type addChainResponse struct {
+	SCTVersion uint8  `json:"sct_version"`
+	ID         string `json:"id"`
+	Timestamp  uint64 `json:"timestamp"`
+	Extensions string `json:"extensions"`
+	Signature  string `json:"signature"`
+}
+
+// serializeSCT encodes an SCT as the TLS structure SignedCertificateTimestamp.
+// The signature in the response is already an encoded DigitallySigned.
+func (r *addChainResponse) serializeSCT() ([]byte, error) {
+	id, err := base64.StdEncoding.DecodeString(r.ID)
+	if err != nil || len(id) != 32 {
+		return nil, fmt.Errorf("invalid log ID %q", r.ID)
+	}
+	ext, err := base64.StdEncoding.DecodeString(r.Extensions)
+	if err != nil {
+		return nil, fmt.Errorf("invalid SCT extensions: %s", err)
+	}
+	sig, err := base64.StdEncoding.DecodeString(r.Signature)
+	if err != nil || len(sig) < 4 {
+		return nil, fmt.Errorf("invalid SCT signature")
+	}
+	var b bytes.Buffer
+	b.WriteByte(r.SCTVersion)
+	b.Write(id)
+	binary.Write(&b, binary.BigEndian, r.Timestamp)
+	binary.Write(&b, binary.BigEndian, uint16(len(ext)))
+	b.Write(ext)
+	b.Write(sig)
+	return b.Bytes(), nil
+}
+
+// submitPrecert posts a precertificate and its issuer to the log at logURL
+// and returns the serialized SCT.
+func submitPrecert(logURL string, precert, issuer []byte) ([]byte, error) {
+	body, err := json.Marshal(struct {
+		Chain [][]byte `json:"chain"`
+	}{[][]byte{precert, issuer}})
+	if err != nil {
+		return nil, err
+	}
+	client := &http.Client{Timeout: 30 * time.Second}
+	endpoint := strings.TrimSuffix(logURL, "/") + "/ct/v1/add-pre-chain"
+	resp, err := client.Post(endpoint, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	respBody, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("%s: %s %s", endpoint, resp.Status, bytes.TrimSpace(respBody))
+	}
+	var r addChainResponse
+	if err := json.Unmarshal(respBody, &r); err != nil {
+		return nil, fmt.Errorf("%s: %s", endpoint, err)
+	}
+	return r.serializeSCT()
+}
+
+// sctListExtension returns the embedded SCT list extension holding scts.
+func sctListExtension(scts ...[]byte) (pkix.Extension, error) {
+	var list bytes.Buffer
+	for _, sct := range scts {
+		binary.Write(&list, binary.BigEndian, uint16(len(sct)))
+		list.Write(sct)
+	}
+	var b bytes.Buffer
+	binary.Write(&b, binary.BigEndian, uint16(list.Len()))
+	b.Write(list.Bytes())
+	value, err := asn1.Marshal(b.Bytes())
+	if err != nil {
+		return pkix.Extension{}, err
+	}
+	return pkix.Extension{Id: oidCTSCTList, Value: value}, nil
+}
+
+// embedSCT submits a precertificate for template to the log at logURL and
+// adds the returned SCT to template. The precertificate gets the unique
+// identifiers the final certificate will, as the SCT covers them. Log
+// failures are only reported, and the certificate is issued without an SCT.
+func embedSCT(logURL string, template *x509.Certificate, iss *issuer, pubKey interface{}) {
+	precertTemplate := *template
+	precertTemplate.ExtraExtensions = append(append([]pkix.Extension(nil), template.ExtraExtensions...),
+		pkix.Extension{Id: oidCTPoison, Critical: true, Value: asn1.NullBytes})
+	precert, err := createCertificate(&precertTemplate, iss.cert, pubKey, certSigner(iss.key))
+	if err == nil && (issuerUniqueID != nil || subjectUniqueID != nil) {
+		precert, err = addUniqueIDs(precert, issuerUniqueID, subjectUniqueID, certSigner(iss.key))
+	}
+	if err != nil {
+		log.Printf("warning: creating precertificate for %s: %s; issuing without an SCT", logURL, err)
+		return
+	}
+	sct, err := submitPrecert(logURL, precert, iss.cert.Raw)
+	if err != nil {
+		log.Printf("warning: CT log: %s; issuing without an SCT", err)
+		return
+	}
+	ext, err := sctListExtension(sct)
+	if err != nil {
+		log.Printf("warning: encoding SCT: %s; issuing without an SCT", err)
+		return
+	}
+	template.ExtraExtensions = append(template.ExtraExtensions, ext)
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"bytes"
+	"encoding/asn1"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// tbsWithoutExtension returns the TBSCertificate of the DER certificate der
+// with the extension oid removed, as a CT log reconstructs it (RFC 6962,
+// section 3.2).
+func tbsWithoutExtension(t *testing.T, der []byte, oid asn1.ObjectIdentifier) []byte {
+	t.Helper()
+	var cert certificateASN1
+	if _, err := asn1.Unmarshal(der, &cert); err != nil {
+		t.Fatal(err)
+	}
+	var tbs []asn1.RawValue
+	if _, err := asn1.Unmarshal(cert.TBSCertificate.FullBytes, &tbs); err != nil {
+		t.Fatal(err)
+	}
+	last := len(tbs) - 1
+	var exts []asn1.RawValue
+	if _, err := asn1.Unmarshal(tbs[last].Bytes, &exts); err != nil {
+		t.Fatal(err)
+	}
+	var kept []asn1.RawValue
+	for _, ext := range exts {
+		var id asn1.ObjectIdentifier
+		if _, err := asn1.Unmarshal(ext.Bytes, &id); err != nil {
+			t.Fatal(err)
+		}
+		if !id.Equal(oid) {
+			kept = append(kept, ext)
+		}
+	}
+	extsDER, err := asn1.Marshal(kept)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tbs[last] = asn1.RawValue{Class: asn1.ClassContextSpecific, Tag: 3, IsCompound: true, Bytes: extsDER}
+	tbsDER, err := asn1.Marshal(tbs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return tbsDER
+}
+
+// The precertificate submitted to the log has the same TBSCertificate as
+// the final certificate, apart from the poison and SCT extensions, even
+// with unique identifiers.
+func TestCTPrecertMatches(t *testing.T) {
+	defer func(old string) { ctLog = old }(ctLog)
+	defer func(old []byte) { issuerUniqueID = old }(issuerUniqueID)
+	defer func(old []byte) { subjectUniqueID = old }(subjectUniqueID)
+	issuerUniqueID, subjectUniqueID = []byte{1, 2}, []byte{3, 4}
+	var precert []byte
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var req struct{ Chain [][]byte }
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil || len(req.Chain) == 0 {
+			http.Error(w, "bad request", http.StatusBadRequest)
+			return
+		}
+		precert = req.Chain[0]
+		json.NewEncoder(w).Encode(addChainResponse{
+			ID:        base64.StdEncoding.EncodeToString(make([]byte, 32)),
+			Timestamp: 1,
+			Signature: base64.StdEncoding.EncodeToString([]byte{4, 3, 0, 0}),
+		})
+	}))
+	defer srv.Close()
+	ctLog = srv.URL
+	iss := testIssuer(t)
+	cert, err := testSign(t, iss, &leafSpec{domains: []string{"ct.example"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if precert == nil {
+		t.Fatal("no precertificate submitted")
+	}
+	if err := cert.CheckSignatureFrom(iss.cert); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(tbsWithoutExtension(t, precert, oidCTPoison), tbsWithoutExtension(t, cert.Raw, oidCTSCTList)) {
+		t.Errorf("the final certificate doesn't match the precertificate the SCT covers")
+	}
+}
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/sha256"
+	"io"
+	"math/big"
+	"time"
+)
+
+// Deterministic key generation for -deterministic-seed. The standard
+// library deliberately makes ECDSA and prime generation non-deterministic
+// even with a fixed reader, so keys are derived here directly from the
+// seeded stream. None of this is suitable for real keys.
+
+type zeroReader struct{}
+
+func (zeroReader) Read(p []byte) (int, error) {
+	for i := range p {
+		p[i] = 0
+	}
+	return len(p), nil
+}
+
+// seededReader returns an endless deterministic stream of bytes derived from
+// seed: the AES-256-CTR keystream keyed with SHA-256(seed).
+func seededReader(seed []byte) io.Reader {
+	key := sha256.Sum256(seed)
+	block, err := aes.NewCipher(key[:])
+	if err != nil {
+		panic(err)
+	}
+	stream := cipher.NewCTR(block, make([]byte, aes.BlockSize))
+	return cipher.StreamReader{S: stream, R: zeroReader{}}
+}
+
+// signingRandom returns the source of randomness for a single signature.
+// Signing can consume a varying number of bytes, so under -deterministic-seed
+// each signature gets its own stream derived from random, keeping the keys
+// and serial numbers that follow reproducible.
+func signingRandom() io.Reader {
+	if !seeded {
+		return random
+	}
+	seed := make([]byte, 32)
+	if _, err := io.ReadFull(random, seed); err != nil {
+		panic(err)
+	}
+	return seededReader(seed)
+}
+
+// now returns the time certificates are issued at.
+func now() time.Time {
+	if !fixedTime.IsZero() {
+		return fixedTime
+	}
+	return time.Now()
+}
+
+// deterministicECDSAKey derives an ECDSA key on curve c from r, using the
+// extra random bits method of FIPS 186-4, appendix B.4.1.
+func deterministicECDSAKey(c elliptic.Curve, r io.Reader) (*ecdsa.PrivateKey, error) {
+	params := c.Params()
+	b := make([]byte, params.BitSize/8+8)
+	if _, err := io.ReadFull(r, b); err != nil {
+		return nil, err
+	}
+	one := big.NewInt(1)
+	k := new(big.Int).SetBytes(b)
+	n := new(big.Int).Sub(params.N, one)
+	k.Mod(k, n)
+	k.Add(k, one)
+
+	priv := &ecdsa.PrivateKey{D: k}
+	priv.PublicKey.Curve = c
+	priv.PublicKey.X, priv.PublicKey.Y = c.ScalarBaseMult(k.Bytes())
+	return priv, nil
+}
+
+// deterministicPrime returns a prime of exactly bits bits with its top two
+// bits set, drawing candidates from r.
+func deterministicPrime(r io.Reader, bits int) (*big.Int, error) {
+	b := make([]byte, (bits+7)/8)
+	for {
+		if _, err := io.ReadFull(r, b); err != nil {
+			return nil, err
+		}
+		b[0] &= byte(0xff >> uint(len(b)*8-bits))
+		p := new(big.Int).SetBytes(b)
+		p.SetBit(p, bits-1, 1)
+		p.SetBit(p, bits-2, 1)
+		p.SetBit(p, 0, 1)
+		if p.ProbablyPrime(20) {
+			return p, nil
+		}
+	}
+}
+
+// rsaKeyFromReader derives a two prime RSA key of the given size and public
+// exponent from r. Besides -deterministic-seed, it serves -rsa-exponent,
+// since rsa.GenerateKey always uses 65537.
+func rsaKeyFromReader(r io.Reader, bits, exponent int) (*rsa.PrivateKey, error) {
+	one := big.NewInt(1)
+	e := big.NewInt(int64(exponent))
+	for {
+		p, err := deterministicPrime(r, bits-bits/2)
+		if err != nil {
+			return nil, err
+		}
+		q, err := deterministicPrime(r, bits/2)
+		if err != nil {
+			return nil, err
+		}
+		if p.Cmp(q) == 0 {
+			continue
+		}
+		n := new(big.Int).Mul(p, q)
+		if n.BitLen() != bits {
+			continue
+		}
+		pMinus1 := new(big.Int).Sub(p, one)
+		qMinus1 := new(big.Int).Sub(q, one)
+		phi := new(big.Int).Mul(pMinus1, qMinus1)
+		d := new(big.Int).ModInverse(e, phi)
+		if d == nil {
+			continue
+		}
+		key := &rsa.PrivateKey{
+			PublicKey: rsa.PublicKey{N: n, E: int(e.Int64())},
+			D:         d,
+			Primes:    []*big.Int{p, q},
+		}
+		key.Precompute()
+		if err := key.Validate(); err != nil {
+			return nil, err
+		}
+		return key, nil
+	}
+}
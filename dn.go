@@ -0,0 +1,126 @@
+package main
+
+import (
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/hex"
+	"strings"
+)
+
+// dnAttributeTypes are the attribute type names accepted by parseDN, those
+// of RFC 4514, section 3, and the serial number.
+var dnAttributeTypes = map[string]asn1.ObjectIdentifier{
+	"CN":           {2, 5, 4, 3},
+	"SERIALNUMBER": {2, 5, 4, 5},
+	"C":            {2, 5, 4, 6},
+	"L":            {2, 5, 4, 7},
+	"ST":           {2, 5, 4, 8},
+	"STREET":       {2, 5, 4, 9},
+	"O":            {2, 5, 4, 10},
+	"OU":           {2, 5, 4, 11},
+	"DC":           {0, 9, 2342, 19200300, 100, 1, 25},
+	"UID":          {0, 9, 2342, 19200300, 100, 1, 1},
+}
+
+var oidDomainComponent = dnAttributeTypes["DC"]
+
+// splitDN splits s at each sep that isn't escaped with a backslash.
+func splitDN(s string, sep byte) []string {
+	var parts []string
+	start := 0
+	for i := 0; i < len(s); i++ {
+		switch s[i] {
+		case '\\':
+			i++
+		case sep:
+			parts = append(parts, s[start:i])
+			start = i + 1
+		}
+	}
+	return append(parts, s[start:])
+}
+
+// unescapeDN resolves the backslash escapes of an RFC 4514 attribute value.
+func unescapeDN(s string) (string, bool) {
+	var b []byte
+	for i := 0; i < len(s); i++ {
+		if s[i] != '\\' {
+			b = append(b, s[i])
+			continue
+		}
+		if i+1 >= len(s) {
+			return "", false
+		}
+		if i+2 < len(s) {
+			if c, err := hex.DecodeString(s[i+1 : i+3]); err == nil {
+				b = append(b, c[0])
+				i += 2
+				continue
+			}
+		}
+		if !strings.ContainsRune(`\"+,;<>= #`, rune(s[i+1])) {
+			return "", false
+		}
+		b = append(b, s[i+1])
+		i++
+	}
+	return string(b), true
+}
+
+// parseDN parses an RFC 4514 distinguished name such as
+// "CN=web,OU=Ops,O=Example\, Inc.,C=US", whose most specific attribute
+// comes first, into an RDN sequence in certificate order. Types are the
+// names in dnAttributeTypes or dotted OIDs, and a value starting with #
+// is the hex of a BER encoded value.
+func parseDN(s string) (pkix.RDNSequence, error) {
+	if strings.TrimSpace(s) == "" {
+		return nil, usageErrorf("empty -subject")
+	}
+	var seq pkix.RDNSequence
+	commonNames := 0
+	for _, rdn := range splitDN(s, ',') {
+		var set pkix.RelativeDistinguishedNameSET
+		for _, attr := range splitDN(rdn, '+') {
+			i := strings.Index(attr, "=")
+			if i < 0 {
+				return nil, usageErrorf("invalid -subject %q: %q isn't type=value", s, attr)
+			}
+			typ := strings.TrimSpace(attr[:i])
+			value := attr[i+1:]
+			oid, ok := dnAttributeTypes[strings.ToUpper(typ)]
+			if !ok {
+				var err error
+				oid, err = parseOID(typ)
+				if err != nil {
+					return nil, usageErrorf("invalid -subject %q: unknown attribute type %q", s, typ)
+				}
+			}
+			if oid.Equal(oidCommonName) {
+				commonNames++
+			}
+			var v interface{}
+			if strings.HasPrefix(value, "#") {
+				der, err := hex.DecodeString(value[1:])
+				if err != nil {
+					return nil, usageErrorf("invalid -subject %q: bad hex value %q", s, value)
+				}
+				v = asn1.RawValue{FullBytes: der}
+			} else {
+				unescaped, ok := unescapeDN(value)
+				if !ok {
+					return nil, usageErrorf("invalid -subject %q: bad escape in %q", s, value)
+				}
+				v = unescaped
+				if oid.Equal(oidDomainComponent) {
+					v = asn1.RawValue{Tag: asn1.TagIA5String, Bytes: []byte(unescaped)}
+				}
+			}
+			set = append(set, pkix.AttributeTypeAndValue{Type: oid, Value: v})
+		}
+		seq = append(pkix.RDNSequence{set}, seq...)
+	}
+	if commonNames > 1 {
+		return nil, usageErrorf("invalid -subject %q: a subject may have only one Common Name", s)
+	}
+	return seq, nil
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"crypto/elliptic"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+)
+
+// Some tools write the EC point in a certificate's public key in compressed
+// form (SEC 1, section 2.3.3), which crypto/x509 refuses to parse.
+
+var (
+	oidPublicKeyECDSA = asn1.ObjectIdentifier{1, 2, 840, 10045, 2, 1}
+	oidNamedCurveP224 = asn1.ObjectIdentifier{1, 3, 132, 0, 33}
+	oidNamedCurveP256 = asn1.ObjectIdentifier{1, 2, 840, 10045, 3, 1, 7}
+	oidNamedCurveP384 = asn1.ObjectIdentifier{1, 3, 132, 0, 34}
+	oidNamedCurveP521 = asn1.ObjectIdentifier{1, 3, 132, 0, 35}
+)
+
+type subjectPublicKeyInfo struct {
+	Algorithm pkix.AlgorithmIdentifier
+	PublicKey asn1.BitString
+}
+
+func namedCurve(oid asn1.ObjectIdentifier) elliptic.Curve {
+	switch {
+	case oid.Equal(oidNamedCurveP224):
+		return elliptic.P224()
+	case oid.Equal(oidNamedCurveP256):
+		return elliptic.P256()
+	case oid.Equal(oidNamedCurveP384):
+		return elliptic.P384()
+	case oid.Equal(oidNamedCurveP521):
+		return elliptic.P521()
+	}
+	return nil
+}
+
+// uncompressSPKI returns spki with its EC point uncompressed, or nil if it
+// isn't an EC public key with a compressed point.
+func uncompressSPKI(der []byte) []byte {
+	var spki subjectPublicKeyInfo
+	rest, err := asn1.Unmarshal(der, &spki)
+	if err != nil || len(rest) > 0 || !spki.Algorithm.Algorithm.Equal(oidPublicKeyECDSA) {
+		return nil
+	}
+	var curveOID asn1.ObjectIdentifier
+	if _, err := asn1.Unmarshal(spki.Algorithm.Parameters.FullBytes, &curveOID); err != nil {
+		return nil
+	}
+	curve := namedCurve(curveOID)
+	point := spki.PublicKey.RightAlign()
+	if curve == nil || len(point) == 0 || point[0] != 2 && point[0] != 3 {
+		return nil
+	}
+	x, y := elliptic.UnmarshalCompressed(curve, point)
+	if x == nil {
+		return nil
+	}
+	uncompressed := elliptic.Marshal(curve, x, y)
+	spki.PublicKey = asn1.BitString{Bytes: uncompressed, BitLength: 8 * len(uncompressed)}
+	der, err = asn1.Marshal(spki)
+	if err != nil {
+		return nil
+	}
+	return der
+}
+
+// uncompressCertKey returns the DER certificate cert with a compressed EC
+// public key rewritten in uncompressed form, or nil if there's nothing to
+// rewrite. The signature no longer covers the result, so it's only useful
+// for reading the certificate's fields.
+func uncompressCertKey(cert []byte) []byte {
+	var certElems, tbsElems []asn1.RawValue
+	if _, err := asn1.Unmarshal(cert, &certElems); err != nil || len(certElems) != 3 {
+		return nil
+	}
+	if _, err := asn1.Unmarshal(certElems[0].FullBytes, &tbsElems); err != nil {
+		return nil
+	}
+	for i, elem := range tbsElems {
+		spki := uncompressSPKI(elem.FullBytes)
+		if spki == nil {
+			continue
+		}
+		tbsElems[i] = asn1.RawValue{FullBytes: spki}
+		tbs, err := asn1.Marshal(tbsElems)
+		if err != nil {
+			return nil
+		}
+		certElems[0] = asn1.RawValue{FullBytes: tbs}
+		der, err := asn1.Marshal(certElems)
+		if err != nil {
+			return nil
+		}
+		return der
+	}
+	return nil
+}
+
+// restoreRaw sets the raw encodings in cert, parsed from a rewritten copy
+// of the DER certificate der, back to those of der.
+func restoreRaw(cert *x509.Certificate, der []byte) {
+	cert.Raw = der
+	var certElems, tbsElems []asn1.RawValue
+	if _, err := asn1.Unmarshal(der, &certElems); err != nil || len(certElems) != 3 {
+		return
+	}
+	cert.RawTBSCertificate = certElems[0].FullBytes
+	if _, err := asn1.Unmarshal(certElems[0].FullBytes, &tbsElems); err != nil || len(tbsElems) <= spkiIndex {
+		return
+	}
+	i := spkiIndex
+	if tbsElems[0].Class != asn1.ClassContextSpecific || tbsElems[0].Tag != 0 {
+		// A version 1 certificate, without the version.
+		i--
+	}
+	cert.RawSubjectPublicKeyInfo = tbsElems[i].FullBytes
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/elliptic"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/pem"
+	"path/filepath"
+	"testing"
+)
+
+// A CA whose certificate has its EC point in compressed form still matches
+// its key, and leaves issued from it chain to it.
+func TestCompressedPointCA(t *testing.T) {
+	key := testKey(t)
+	ca := testCA(t, "compressed CA", -1, key, nil, nil)
+	spkiDER, err := x509.MarshalPKIXPublicKey(&key.PublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var spki subjectPublicKeyInfo
+	if _, err := asn1.Unmarshal(spkiDER, &spki); err != nil {
+		t.Fatal(err)
+	}
+	point := elliptic.MarshalCompressed(key.Curve, key.X, key.Y)
+	spki.PublicKey = asn1.BitString{Bytes: point, BitLength: 8 * len(point)}
+	compressed, err := asn1.Marshal(spki)
+	if err != nil {
+		t.Fatal(err)
+	}
+	der, err := resignCertificate(ca.Raw, key, func(tbs []asn1.RawValue) []asn1.RawValue {
+		tbs[spkiIndex] = asn1.RawValue{FullBytes: compressed}
+		return tbs
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dir := t.TempDir()
+	keyFile, certFile := filepath.Join(dir, "ca-key.pem"), filepath.Join(dir, "ca.pem")
+	p8, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := writePEM(keyFile, &pem.Block{Type: "PRIVATE KEY", Bytes: p8}); err != nil {
+		t.Fatal(err)
+	}
+	if err := writePEM(certFile, &pem.Block{Type: "CERTIFICATE", Bytes: der}); err != nil {
+		t.Fatal(err)
+	}
+	iss, err := getIssuer(context.Background(), keyFile, certFile)
+	if err != nil {
+		t.Fatalf("compressed point CA doesn't match its key: %s", err)
+	}
+	if !bytes.Equal(iss.cert.Raw, der) {
+		t.Errorf("CA certificate wasn't kept in its original encoding")
+	}
+	if !bytes.Equal(iss.cert.RawSubjectPublicKeyInfo, compressed) {
+		t.Errorf("CA public key wasn't kept in compressed form")
+	}
+	if err := iss.cert.CheckSignatureFrom(iss.cert); err != nil {
+		t.Errorf("CA self-signature doesn't verify: %s", err)
+	}
+
+	leaf, err := testSign(t, iss, &leafSpec{domains: []string{"leaf.example"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := leaf.CheckSignatureFrom(iss.cert); err != nil {
+		t.Errorf("leaf doesn't verify against the CA: %s", err)
+	}
+	if !bytes.Equal(leaf.RawIssuer, iss.cert.RawSubject) || leaf.Issuer.String() != (pkix.Name{CommonName: "compressed CA"}).String() {
+		t.Errorf("leaf issuer is %s", leaf.Issuer)
+	}
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"strings"
+	"time"
+)
+
+// describeValidity describes a leaf validity period, zero meaning the
+// default.
+func describeValidity(validity time.Duration) string {
+	if validity == 0 {
+		return "2-year-and-30-day"
+	}
+	days := validity.Hours() / 24
+	if days == float64(int(days)) {
+		return fmt.Sprintf("%d-day", int(days))
+	}
+	return validity.String()
+}
+
+// describeNewKey describes a key of type kt that would be generated.
+func describeNewKey(kt keyType) string {
+	switch kt.algorithm {
+	case "ed25519":
+		return "Ed25519"
+	case "rsa":
+		return fmt.Sprintf("RSA %d-bit", kt.rsaBits)
+	}
+	return "ECDSA " + kt.curve
+}
+
+// explain describes the certificates that issuing specs would produce. iss
+// is nil when the CA doesn't exist yet and would be created.
+func explain(w io.Writer, specs []*leafSpec, iss *issuer) error {
+	var issuerDesc string
+	caKT := flagKeyType()
+	if iss != nil {
+		issuerDesc = fmt.Sprintf("%s (%s, expires %s)", iss.cert.Subject, keyDescription(iss.cert.PublicKey),
+			iss.cert.NotAfter.Format("2006-01-02"))
+		caKT = publicKeyType(iss.cert.PublicKey)
+	} else {
+		issuerDesc = fmt.Sprintf("a new %s CA named %q, created first", describeNewKey(caKT), caName)
+	}
+	// The signature algorithm follows the CA key, not the leaf key.
+	sigAlg := leafSignatureAlgorithm(caKT)
+	for _, spec := range specs {
+		cn, cnFolder, err := leafName(spec)
+		if err != nil {
+			return err
+		}
+		keyDesc := describeNewKey(spec.newKeyType())
+		switch {
+		case spec.pubKey != nil:
+			keyDesc = keyDescription(spec.pubKey)
+		case refresh:
+			keyDesc = "existing-key"
+		}
+		var names []string
+		if !noSAN {
+			names = append(append(names, spec.domains...), spec.ipAddresses...)
+		}
+		if len(names) == 0 {
+			names = []string{"Common Name " + cn + " (no SANs)"}
+		}
+		usages := "serverAuth+clientAuth"
+		if ocspResponder {
+			usages = "OCSPSigning"
+		}
+		fmt.Fprintf(w, "This will create a %s %s leaf for %s, signed with %s by %s, with %s, saved to %s.\n",
+			describeValidity(spec.validity), keyDesc, strings.Join(names, ", "), sigAlg, issuerDesc, usages,
+			strings.TrimSuffix(cnFolder, "/")+"/")
+	}
+	return nil
+}
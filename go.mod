@@ -1,3 +1,8 @@
 module suah.dev/microca
 
 go 1.15
+
+require (
+	github.com/decred/dcrd/dcrec/secp256k1/v4 v4.4.0
+	golang.org/x/net v0.10.0
+)
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/pem"
+	"io/ioutil"
+	"net"
+	"strings"
+
+	"golang.org/x/net/idna"
+)
+
+// isASCII reports whether s has only ASCII characters.
+func isASCII(s string) bool {
+	for i := 0; i < len(s); i++ {
+		if s[i] >= 0x80 {
+			return false
+		}
+	}
+	return true
+}
+
+// idnToASCII converts an internationalized domain name to the ASCII form
+// certificates must use, mapping each non-ASCII label as UTS #46 specifies
+// for lookups and encoding it as xn-- followed by its punycode. ASCII
+// labels, such as a wildcard, are left to checkDomain.
+func idnToASCII(domain string) (string, error) {
+	labels := strings.Split(domain, ".")
+	for i, label := range labels {
+		if isASCII(label) {
+			continue
+		}
+		encoded, err := idna.Lookup.ToASCII(label)
+		if err != nil {
+			return "", usageErrorf("invalid internationalized label %q: %s", label, err)
+		}
+		labels[i] = encoded
+	}
+	return strings.Join(labels, "."), nil
+}
+
+var oidExtensionSubjectAltName = asn1.ObjectIdentifier{2, 5, 29, 17}
+
+// unicodeSANExtension encodes a Subject Alternative Name extension with
+// the domains, the UTF-8 unicodeDomains and the ips, for -idn-both.
+// crypto/x509 refuses to write dNSNames that aren't ASCII, as RFC 5280
+// requires, so it's encoded by hand.
+func unicodeSANExtension(domains, unicodeDomains []string, ips []net.IP) (pkix.Extension, error) {
+	var names []asn1.RawValue
+	for _, d := range append(append([]string(nil), domains...), unicodeDomains...) {
+		names = append(names, asn1.RawValue{Class: asn1.ClassContextSpecific, Tag: 2, Bytes: []byte(d)})
+	}
+	for _, ip := range ips {
+		names = append(names, asn1.RawValue{Class: asn1.ClassContextSpecific, Tag: 7, Bytes: ip})
+	}
+	value, err := asn1.Marshal(names)
+	if err != nil {
+		return pkix.Extension{}, err
+	}
+	return pkix.Extension{Id: oidExtensionSubjectAltName, Value: value}, nil
+}
+
+// idnBothCert reports whether the certificate at certPath has a dNSName SAN
+// that isn't ASCII, as written by -idn-both. crypto/x509 refuses to parse
+// such certificates, so they're skipped rather than failed when walking
+// leaf folders, and must be re-issued by hand.
+func idnBothCert(certPath string) bool {
+	contents, err := ioutil.ReadFile(certPath)
+	if err != nil {
+		return false
+	}
+	block, _ := pem.Decode(contents)
+	if block == nil {
+		return false
+	}
+	var certElems, tbsElems []asn1.RawValue
+	if _, err := asn1.Unmarshal(block.Bytes, &certElems); err != nil || len(certElems) != 3 {
+		return false
+	} else if _, err := asn1.Unmarshal(certElems[0].FullBytes, &tbsElems); err != nil || len(tbsElems) == 0 {
+		return false
+	}
+	last := tbsElems[len(tbsElems)-1]
+	if last.Class != asn1.ClassContextSpecific || last.Tag != 3 {
+		return false
+	}
+	var exts []pkix.Extension
+	if _, err := asn1.Unmarshal(last.Bytes, &exts); err != nil {
+		return false
+	}
+	for _, ext := range exts {
+		if !ext.Id.Equal(oidExtensionSubjectAltName) {
+			continue
+		}
+		var names []asn1.RawValue
+		if _, err := asn1.Unmarshal(ext.Value, &names); err != nil {
+			return false
+		}
+		for _, n := range names {
+			if n.Class == asn1.ClassContextSpecific && n.Tag == 2 && !isASCII(string(n.Bytes)) {
+				return true
+			}
+		}
+	}
+	return false
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"math/big"
+)
+
+// jwk is a JSON Web Key (RFC 7517) holding an RSA, EC (RFC 7518) or OKP
+// (RFC 8037) key. Private members are omitted for public keys.
+type jwk struct {
+	Kty string `json:"kty"`
+	Crv string `json:"crv,omitempty"`
+
+	// RSA
+	N  string `json:"n,omitempty"`
+	E  string `json:"e,omitempty"`
+	D  string `json:"d,omitempty"`
+	P  string `json:"p,omitempty"`
+	Q  string `json:"q,omitempty"`
+	DP string `json:"dp,omitempty"`
+	DQ string `json:"dq,omitempty"`
+	QI string `json:"qi,omitempty"`
+
+	// EC and OKP
+	X string `json:"x,omitempty"`
+	Y string `json:"y,omitempty"`
+}
+
+func b64(b []byte) string {
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+// b64Int encodes n in size bytes, or its minimal length if size is zero.
+func b64Int(n *big.Int, size int) string {
+	b := n.Bytes()
+	if len(b) < size {
+		b = append(make([]byte, size-len(b)), b...)
+	}
+	return b64(b)
+}
+
+// marshalJWK encodes a public or private key as a JSON Web Key.
+func marshalJWK(key interface{}) ([]byte, error) {
+	var k jwk
+	switch key := key.(type) {
+	case *rsa.PrivateKey:
+		if len(key.Primes) != 2 {
+			return nil, fmt.Errorf("JWK export of multi-prime RSA keys is not supported")
+		}
+		key.Precompute()
+		k = rsaJWK(&key.PublicKey)
+		k.D = b64Int(key.D, 0)
+		k.P = b64Int(key.Primes[0], 0)
+		k.Q = b64Int(key.Primes[1], 0)
+		k.DP = b64Int(key.Precomputed.Dp, 0)
+		k.DQ = b64Int(key.Precomputed.Dq, 0)
+		k.QI = b64Int(key.Precomputed.Qinv, 0)
+	case *rsa.PublicKey:
+		k = rsaJWK(key)
+	case *ecdsa.PrivateKey:
+		var err error
+		k, err = ecJWK(&key.PublicKey)
+		if err != nil {
+			return nil, err
+		}
+		k.D = b64Int(key.D, (key.Curve.Params().BitSize+7)/8)
+	case *ecdsa.PublicKey:
+		var err error
+		k, err = ecJWK(key)
+		if err != nil {
+			return nil, err
+		}
+	case ed25519.PrivateKey:
+		k = jwk{Kty: "OKP", Crv: "Ed25519", X: b64(key.Public().(ed25519.PublicKey)), D: b64(key.Seed())}
+	case ed25519.PublicKey:
+		k = jwk{Kty: "OKP", Crv: "Ed25519", X: b64(key)}
+	default:
+		return nil, fmt.Errorf("JWK export of %T keys is not supported", key)
+	}
+	return json.MarshalIndent(k, "", "  ")
+}
+
+func rsaJWK(key *rsa.PublicKey) jwk {
+	return jwk{Kty: "RSA", N: b64Int(key.N, 0), E: b64Int(big.NewInt(int64(key.E)), 0)}
+}
+
+func ecJWK(key *ecdsa.PublicKey) (jwk, error) {
+	var crv string
+	switch name := key.Curve.Params().Name; name {
+	case "P-256", "P-384", "P-521", "secp256k1":
+		crv = name
+	default:
+		return jwk{}, fmt.Errorf("JWK has no registered name for curve %s", name)
+	}
+	size := (key.Curve.Params().BitSize + 7) / 8
+	return jwk{Kty: "EC", Crv: crv, X: b64Int(key.X, size), Y: b64Int(key.Y, size)}, nil
+}
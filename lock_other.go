@@ -0,0 +1,11 @@
+//go:build !darwin && !dragonfly && !freebsd && !linux && !netbsd && !openbsd
+// +build !darwin,!dragonfly,!freebsd,!linux,!netbsd,!openbsd
+
+package main
+
+import "os"
+
+// lockFile does nothing where flock isn't available.
+func lockFile(f *os.File) error {
+	return nil
+}
@@ -1,7 +1,9 @@
 package main
 
 import (
+	"bufio"
 	"bytes"
+	"context"
 	"crypto"
 	"crypto/ecdsa"
 	"crypto/ed25519"
@@ -9,39 +11,268 @@ import (
 	"crypto/rand"
 	"crypto/rsa"
 	"crypto/sha1"
+	"crypto/sha256"
 	"crypto/x509"
 	"crypto/x509/pkix"
 	"encoding/asn1"
+	"encoding/base32"
+	"encoding/hex"
+	"encoding/json"
 	"encoding/pem"
+	"errors"
 	"flag"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"log"
 	"math"
 	"math/big"
 	"net"
+	"net/url"
 	"os"
+	"os/exec"
+	"os/signal"
 	"path"
 	"path/filepath"
 	"regexp"
+	"sort"
+	"strconv"
 	"strings"
+	"syscall"
 	"text/tabwriter"
 	"time"
 )
 
 var (
-	caName     string
-	ecdsaCurve string
-	ed25519Key bool
-	rsaBits    int
-	rsaKey     bool
-	showExp    bool
+	ackCompat             bool
+	allowEmptyCAName      bool
+	backdate              time.Duration
+	bcNonCritical         bool
+	browserCompat         bool
+	caName                string
+	certbotLayout         bool
+	copyCA                bool
+	deterministicECDSA    bool
+	ecdsaCurve            string
+	ed25519Key            bool
+	expired               bool
+	folderHash            bool
+	future                bool
+	grpcProfile           bool
+	idnBoth               bool
+	inhibitAnyPolicy      int
+	inhibitPolicyMapping  int
+	intermediatePathLen   int
+	ipv4Only              bool
+	ipv6Only              bool
+	jsonErrors            bool
+	keepSerial            bool
+	keygenTimeout         time.Duration
+	maxSANs               int
+	mustStapleFlag        bool
+	noAutoCA              bool
+	noDir                 bool
+	noKeyEncipherment     bool
+	noSAN                 bool
+	noSHA1CA              bool
+	ocspResponder         bool
+	overwrite             bool
+	pemStrict             bool
+	postVerify            bool
+	quiet                 bool
+	refresh               bool
+	reissueCACert         bool
+	reproducible          bool
+	requireExplicitPolicy int
+	reuseKey              bool
+	rsaBits               int
+	rsaExponent           int
+	rsaKey                bool
+	serialMode            string
+	showExp               bool
+	strict                bool
+	strictHostnames       bool
+	timeGranularity       time.Duration
+	uploadInsecure        bool
+	verbose               bool
+	warnSANs              int
+	writeJWK              bool
+	writePKCS7            bool
+	writeSerial           bool
+
+	subjectSerial string
+	msSID         string
+	subjectDN     []byte // with -subject, the DER leaf subject
+	netscapeTypes []string
+	uploadURL     string
+	uploadToken   string
+	ctLog         string
+	postHook      string
+	auditLogPath  string
+	subjectExtra  []pkix.AttributeTypeAndValue
+
+	// issuerUniqueID and subjectUniqueID are set in leaf certificates
+	// when not nil.
+	issuerUniqueID  []byte
+	subjectUniqueID []byte
+
+	caDNS  []string
+	caURIs []*url.URL
+
+	// caIssuers are the AIA CA Issuers URLs set in leaf certificates.
+	caIssuers []string
+
+	// outputDir is where leaf folders are created, or with noDir where
+	// leaf files are written. keyFilename and certFilename override the
+	// names of leaf files.
+	outputDir    string
+	keyFilename  string
+	certFilename string
+
+	// caKeyPassword encrypts the CA private key when set, and
+	// leafKeyPassword the leaf private keys.
+	caKeyPassword   []byte
+	leafKeyPassword []byte
+
+	// random is the single source of randomness for keys, serial numbers,
+	// signatures and key encryption. Deployments that must use a specific
+	// DRBG, such as a FIPS approved one, or tests wanting injected
+	// randomness can replace it before main2 runs. Go 1.26 and later only
+	// honor a custom source with GODEBUG=cryptocustomrand=1, which is the
+	// default for this module's go version. seeded is set when
+	// -deterministic-seed replaced it.
+	random io.Reader = rand.Reader
+	seeded bool
+
+	// signatureAlgorithm is the algorithm leaves are signed with, or
+	// x509.UnknownSignatureAlgorithm to let crypto/x509 choose.
+	signatureAlgorithm x509.SignatureAlgorithm
+
+	// cloneFrom, if set by -clone-from, is the certificate whose
+	// extensions leaves copy.
+	cloneFrom *x509.Certificate
+
+	// keyRecipients, set by -key-recipient, are the age recipients leaf
+	// keys are encrypted to.
+	keyRecipients stringList
+
+	// archive, if set by -archive, receives the files of issued
+	// certificates instead of their leaf folders.
+	archive *leafArchive
+
+	// fixedTime, if set by -reproducible, replaces the current time as
+	// the issue time of certificates.
+	fixedTime time.Time
+)
+
+// Patterns that domain names given on the command line must match.
+const (
+	defaultDomainPattern    = "^[A-Za-z0-9.*-]+$"
+	underscoreDomainPattern = "^[A-Za-z0-9.*_-]+$"
+)
+
+// stringList is a flag.Value collecting every occurrence of a repeated flag.
+type stringList []string
+
+func (l *stringList) String() string { return strings.Join(*l, ",") }
+
+func (l *stringList) Set(s string) error {
+	*l = append(*l, s)
+	return nil
+}
+
+// Exit codes returned by microca. Wrapper scripts depend on these, so
+// existing values must not change.
+const (
+	exitFailure = 1 // unclassified error
+	exitUsage   = 2 // invalid flags, domain names or IP addresses
+	exitCA      = 3 // CA missing, unreadable or mismatched
+	exitExists  = 4 // refusing to overwrite an existing file
+	exitVerify  = 5 // verification failed
 )
 
+// exitError associates an exit code with an error.
+type exitError struct {
+	code int
+	err  error
+}
+
+func (e *exitError) Error() string { return e.err.Error() }
+func (e *exitError) Unwrap() error { return e.err }
+
+func usageErrorf(format string, a ...interface{}) error {
+	return &exitError{exitUsage, fmt.Errorf(format, a...)}
+}
+
+func caErrorf(format string, a ...interface{}) error {
+	return &exitError{exitCA, fmt.Errorf(format, a...)}
+}
+
+func verifyErrorf(format string, a ...interface{}) error {
+	return &exitError{exitVerify, fmt.Errorf(format, a...)}
+}
+
+// sanError records which Subject Alternative Name an error is about.
+type sanError struct {
+	san string
+	err error
+}
+
+func (e *sanError) Error() string { return e.err.Error() }
+func (e *sanError) Unwrap() error { return e.err }
+
+var exitCodeNames = map[int]string{
+	exitFailure: "failure",
+	exitUsage:   "usage",
+	exitCA:      "ca",
+	exitExists:  "exists",
+	exitVerify:  "verify",
+}
+
+// printJSONError writes err to w as a JSON object with its exit code, the
+// code's name, the message and, when known, the file and the Subject
+// Alternative Name it concerns.
+func printJSONError(w io.Writer, err error) {
+	code := exitCode(err)
+	report := struct {
+		Code    int    `json:"code"`
+		Kind    string `json:"kind"`
+		Message string `json:"message"`
+		File    string `json:"file,omitempty"`
+		SAN     string `json:"san,omitempty"`
+	}{Code: code, Kind: exitCodeNames[code], Message: err.Error()}
+	var pathErr *os.PathError
+	if errors.As(err, &pathErr) {
+		report.File = pathErr.Path
+	}
+	var se *sanError
+	if errors.As(err, &se) {
+		report.SAN = se.san
+	}
+	json.NewEncoder(w).Encode(report)
+}
+
+// exitCode maps err to one of the exit codes above.
+func exitCode(err error) int {
+	var ee *exitError
+	if errors.As(err, &ee) {
+		return ee.code
+	}
+	if errors.Is(err, os.ErrExist) {
+		return exitExists
+	}
+	return exitFailure
+}
+
 func main() {
 	err := main2()
 	if err != nil {
-		log.Fatal(err)
+		if jsonErrors {
+			printJSONError(os.Stderr, err)
+		} else {
+			log.Print(err)
+		}
+		os.Exit(exitCode(err))
 	}
 }
 
@@ -50,49 +281,218 @@ type issuer struct {
 	cert *x509.Certificate
 }
 
-func getIssuer(keyFile, certFile string) (*issuer, error) {
-	keyContents, keyErr := ioutil.ReadFile(keyFile)
-	certContents, certErr := ioutil.ReadFile(certFile)
+// envPrefix marks a -ca-key or -ca-cert naming an environment variable
+// holding the PEM data rather than a file.
+const envPrefix = "env:"
+
+// caPaths returns the key and certificate files of the CA called name, for
+// -ca, from pattern: the two file names separated by a comma, with {name}
+// replaced.
+func caPaths(name, pattern string) (keyFile, certFile string, err error) {
+	parts := strings.Split(pattern, ",")
+	if len(parts) != 2 || !strings.Contains(parts[0], "{name}") || !strings.Contains(parts[1], "{name}") {
+		return "", "", usageErrorf("invalid -ca-pattern %q, expected two file names containing {name}, such as {name}-key.pem,{name}.pem", pattern)
+	}
+	if name == "." || name == ".." || strings.ContainsAny(name, `/\`) {
+		return "", "", usageErrorf("invalid -ca name %q", name)
+	}
+	keyFile = strings.Replace(strings.TrimSpace(parts[0]), "{name}", name, -1)
+	certFile = strings.Replace(strings.TrimSpace(parts[1]), "{name}", name, -1)
+	return keyFile, certFile, nil
+}
+
+// readSource reads a file, an environment variable named as env:NAME or a
+// CA certificate from the system trust store named as system:TEXT.
+func readSource(name string) ([]byte, error) {
+	if strings.HasPrefix(name, systemPrefix) {
+		return findSystemCA(name[len(systemPrefix):])
+	}
+	if !strings.HasPrefix(name, envPrefix) {
+		return ioutil.ReadFile(name)
+	}
+	value, ok := os.LookupEnv(name[len(envPrefix):])
+	if !ok {
+		return nil, fmt.Errorf("environment variable %s is not set", name[len(envPrefix):])
+	}
+	return []byte(value), nil
+}
+
+func getIssuer(ctx context.Context, keyFile, certFile string) (*issuer, error) {
+	for _, name := range []string{keyFile, certFile} {
+		if info, err := os.Stat(name); err == nil && info.IsDir() {
+			return nil, caErrorf("%s is a directory, not a PEM file; check -ca-key and -ca-cert", name)
+		}
+	}
+	keyContents, keyErr := readSource(keyFile)
+	certContents, certErr := readSource(certFile)
+	if strings.HasPrefix(keyFile, envPrefix) || strings.HasPrefix(certFile, envPrefix) || strings.HasPrefix(certFile, systemPrefix) {
+		// A CA passed in the environment or found in the system trust
+		// store is never created or reissued.
+		if keyErr != nil {
+			return nil, caErrorf("reading CA key: %s", keyErr)
+		} else if certErr != nil {
+			return nil, caErrorf("reading CA certificate: %s", certErr)
+		}
+	}
 	if os.IsNotExist(keyErr) && os.IsNotExist(certErr) {
-		err := makeIssuer(keyFile, certFile)
+		if noAutoCA {
+			return nil, caErrorf("no CA found: neither %s nor %s exists, and -no-auto-ca prevents creating one; check -ca-key and -ca-cert", keyFile, certFile)
+		}
+		err := makeIssuer(ctx, keyFile, certFile)
+		if err != nil {
+			return nil, err
+		}
+		return getIssuer(ctx, keyFile, certFile)
+	} else if keyErr == nil && os.IsNotExist(certErr) && reissueCACert {
+		key, err := readPrivateKey(keyContents, caKeyPassword)
+		if err != nil {
+			return nil, caErrorf("reading private key from %s: %s", keyFile, err)
+		}
+		_, err = makeRootCert(key, certFile)
 		if err != nil {
 			return nil, err
 		}
-		return getIssuer(keyFile, certFile)
+		return getIssuer(ctx, keyFile, certFile)
 	} else if keyErr != nil {
-		return nil, fmt.Errorf("%s (but %s exists)", keyErr, certFile)
+		return nil, caErrorf("%s (but %s exists)", keyErr, certFile)
+	} else if os.IsNotExist(certErr) {
+		return nil, caErrorf("%s (but %s exists; use -reissue-ca-cert to create a new CA certificate for it)", certErr, keyFile)
 	} else if certErr != nil {
-		return nil, fmt.Errorf("%s (but %s exists)", certErr, keyFile)
+		return nil, caErrorf("%s (but %s exists)", certErr, keyFile)
 	}
-	key, err := readPrivateKey(keyContents)
+	key, err := readPrivateKey(keyContents, caKeyPassword)
 	if err != nil {
-		return nil, fmt.Errorf("reading private key from %s: %s", keyFile, err)
+		return nil, caErrorf("reading private key from %s: %s", keyFile, err)
 	}
 	pubKey := publicKey(key)
 
-	cert, err := parseCert(certContents)
+	certs, err := parseCerts(certContents)
 	if err != nil {
-		return nil, fmt.Errorf("reading CA certificate from %s: %s", certFile, err)
+		return nil, caErrorf("reading CA certificate from %s: %s", certFile, err)
 	}
 
-	equal, err := publicKeysEqual(pubKey, cert.PublicKey)
-	if err != nil {
-		return nil, fmt.Errorf("comparing public keys: %s", err)
-	} else if !equal {
-		return nil, fmt.Errorf("public key in CA certificate %s doesn't match private key in %s",
+	// certFile may be a bundle of several CAs; use the one for this key.
+	var cert *x509.Certificate
+	for _, c := range certs {
+		equal, err := publicKeysEqual(pubKey, c.PublicKey)
+		if err != nil {
+			return nil, caErrorf("comparing public keys: %s", err)
+		} else if equal {
+			cert = c
+			break
+		}
+	}
+	if cert == nil && len(certs) == 1 {
+		return nil, caErrorf("public key in CA certificate %s doesn't match private key in %s",
 			certFile, keyFile)
+	} else if cert == nil {
+		return nil, caErrorf("none of the %d certificates in %s matches the private key in %s",
+			len(certs), certFile, keyFile)
+	}
+	err = checkIssuerStrength(cert, pubKey)
+	if err != nil {
+		return nil, err
+	}
+	err = checkPathLen(cert, certs)
+	if err != nil {
+		return nil, err
+	}
+	if intermediatePathLen >= 0 && (cert.MaxPathLen != intermediatePathLen || intermediatePathLen == 0 && !cert.MaxPathLenZero) {
+		return nil, caErrorf("CA certificate %s has %s, not the pathLenConstraint of %d given by -intermediate-path-len", cert.Subject, describePathLen(cert), intermediatePathLen)
 	}
 	return &issuer{key, cert}, nil
 }
 
-func readPrivateKey(keyContents []byte) (interface{}, error) {
+// checkPathLen follows the chain from cert through the CAs bundled with it
+// in certs, refusing to issue from an intermediate that a CA above it isn't
+// allowed to have by its pathLenConstraint.
+func checkPathLen(cert *x509.Certificate, certs []*x509.Certificate) error {
+	below := 0
+	for i := 0; i < len(certs); i++ {
+		var parent *x509.Certificate
+		for _, c := range certs {
+			if c != cert && cert.CheckSignatureFrom(c) == nil {
+				parent = c
+				break
+			}
+		}
+		if parent == nil {
+			return nil
+		}
+		if parent.MaxPathLen >= 0 && below >= parent.MaxPathLen {
+			return caErrorf("CA certificate %s allows %d intermediate CAs below it, so %s can't be used to issue", parent.Subject, parent.MaxPathLen, cert.Subject)
+		}
+		below++
+		cert = parent
+	}
+	return nil
+}
+
+// describePathLen describes the pathLenConstraint of a CA certificate.
+func describePathLen(cert *x509.Certificate) string {
+	if cert.MaxPathLen < 0 || cert.MaxPathLen == 0 && !cert.MaxPathLenZero {
+		return "no pathLenConstraint"
+	}
+	return fmt.Sprintf("a pathLenConstraint of %d", cert.MaxPathLen)
+}
+
+// keyDescription describes the algorithm and strength of a public key, for
+// example "RSA 4096 bits" or "ECDSA P-256".
+func keyDescription(pubKey interface{}) string {
+	switch k := pubKey.(type) {
+	case *rsa.PublicKey:
+		return fmt.Sprintf("RSA %d bits", k.N.BitLen())
+	case *ecdsa.PublicKey:
+		return fmt.Sprintf("ECDSA %s", k.Curve.Params().Name)
+	case ed25519.PublicKey:
+		return "Ed25519"
+	}
+	return fmt.Sprintf("unknown key type %T", pubKey)
+}
+
+// checkIssuerStrength reports the CA key's strength under -verbose and warns
+// about roots that should be rotated. With -no-sha1-ca, SHA-1 signed roots
+// are rejected.
+func checkIssuerStrength(cert *x509.Certificate, pubKey interface{}) error {
+	if verbose {
+		log.Printf("CA %s: %s key, signed with %s", cert.Subject, keyDescription(pubKey), cert.SignatureAlgorithm)
+	}
+	if k, ok := pubKey.(*rsa.PublicKey); ok && k.N.BitLen() < 2048 {
+		log.Printf("warning: CA key is %s; keys shorter than 2048 bits are weak, consider rotating the CA", keyDescription(pubKey))
+	}
+	switch cert.SignatureAlgorithm {
+	case x509.SHA1WithRSA, x509.ECDSAWithSHA1, x509.DSAWithSHA1:
+		if noSHA1CA {
+			return caErrorf("CA certificate %s is signed with %s, refusing to use it (-no-sha1-ca)", cert.Subject, cert.SignatureAlgorithm)
+		}
+		log.Printf("WARNING: CA certificate %s is signed with %s. Modern clients distrust SHA-1 "+
+			"signed roots even though the certificates it issues use SHA-2. Rotate the CA soon.",
+			cert.Subject, cert.SignatureAlgorithm)
+	}
+	return nil
+}
+
+// readPrivateKey parses a PEM encoded PKCS #8 private key, decrypting it
+// with password if it's encrypted.
+func readPrivateKey(keyContents []byte, password []byte) (interface{}, error) {
 	block, _ := pem.Decode(keyContents)
 	if block == nil {
 		return nil, fmt.Errorf("no PEM found")
-	} else if block.Type != "PRIVATE KEY" {
-		return nil, fmt.Errorf("incorrect PEM type %s", block.Type)
 	}
-	return x509.ParsePKCS8PrivateKey(block.Bytes)
+	switch block.Type {
+	case "PRIVATE KEY":
+		return parsePKCS8PrivateKey(block.Bytes)
+	case "ENCRYPTED PRIVATE KEY":
+		if password == nil {
+			return nil, fmt.Errorf("key is encrypted but no password was given")
+		}
+		der, err := decryptPKCS8(block.Bytes, password)
+		if err != nil {
+			return nil, err
+		}
+		return parsePKCS8PrivateKey(der)
+	}
+	return nil, fmt.Errorf("incorrect PEM type %s", block.Type)
 }
 
 func readCert(certPath string) (*x509.Certificate, error) {
@@ -104,20 +504,73 @@ func readCert(certPath string) (*x509.Certificate, error) {
 }
 
 func parseCert(certContents []byte) (*x509.Certificate, error) {
-	block, _ := pem.Decode(certContents)
-	if block == nil {
+	certs, err := parseCerts(certContents)
+	if err != nil {
+		return nil, err
+	}
+	return certs[0], nil
+}
+
+// parseCerts parses every certificate in a PEM bundle.
+func parseCerts(certContents []byte) ([]*x509.Certificate, error) {
+	var certs []*x509.Certificate
+	for {
+		var block *pem.Block
+		block, certContents = pem.Decode(certContents)
+		if block == nil {
+			break
+		} else if block.Type != "CERTIFICATE" {
+			return nil, fmt.Errorf("incorrect PEM type %s", block.Type)
+		}
+		cert, err := parseCertDER(block.Bytes)
+		if err != nil {
+			return nil, err
+		}
+		certs = append(certs, cert)
+	}
+	if len(certs) == 0 {
 		return nil, fmt.Errorf("no PEM found")
-	} else if block.Type != "CERTIFICATE" {
-		return nil, fmt.Errorf("incorrect PEM type %s", block.Type)
 	}
-	return x509.ParseCertificate(block.Bytes)
+	return certs, nil
+}
+
+func parseCertDER(der []byte) (*x509.Certificate, error) {
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		// Retry with a compressed EC point uncompressed, keeping the
+		// original encodings in the Raw fields so it's copied out
+		// unchanged and its signature still verifies.
+		uncompressed := uncompressCertKey(der)
+		if uncompressed == nil {
+			if cert := parseSecp256k1Cert(der); cert != nil {
+				return cert, nil
+			}
+			return nil, err
+		}
+		cert, err2 := x509.ParseCertificate(uncompressed)
+		if err2 != nil {
+			return nil, err
+		}
+		restoreRaw(cert, der)
+		return cert, nil
+	}
+	return cert, nil
 }
 
-func makeIssuer(keyFile, certFile string) error {
-	key, err := makeKey(keyFile)
+func makeIssuer(ctx context.Context, keyFile, certFile string) error {
+	if strings.TrimSpace(caName) == "" && !allowEmptyCAName {
+		return usageErrorf("refusing to create a CA with an empty subject; set -ca-name, or pass -allow-empty-ca-name if that's really wanted")
+	}
+	if err := checkSigningKeyType(flagKeyType()); err != nil {
+		return err
+	}
+	key, err := makeKey(ctx, keyFile, caKeyPassword, nil, flagKeyType())
 	if err != nil {
 		return err
 	}
+	if !ackCompat {
+		compatNotice(key)
+	}
 	_, err = makeRootCert(key, certFile)
 	if err != nil {
 		return err
@@ -125,50 +578,259 @@ func makeIssuer(keyFile, certFile string) error {
 	return nil
 }
 
-func makeKey(filename string) (interface{}, error) {
-	var err error
-	var key crypto.PrivateKey
-	var der []byte
+var oidKeyUsage = asn1.ObjectIdentifier{2, 5, 29, 15}
 
-	if ed25519Key || rsaKey {
-		if ed25519Key {
-			_, key, err = ed25519.GenerateKey(rand.Reader)
-		} else {
-			key, err = rsa.GenerateKey(rand.Reader, rsaBits)
-		}
-	} else {
-		switch ecdsaCurve {
-		case "P224":
-			key, err = ecdsa.GenerateKey(elliptic.P224(), rand.Reader)
-		case "P256":
-			key, err = ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
-		case "P384":
-			key, err = ecdsa.GenerateKey(elliptic.P384(), rand.Reader)
-		case "P521":
-			key, err = ecdsa.GenerateKey(elliptic.P521(), rand.Reader)
-		default:
-			return nil, fmt.Errorf("unrecognized curve: %q", ecdsaCurve)
+// makeCACSR generates a CA key in keyFile and writes to csrFile a request
+// for an intermediate CA certificate, to be signed by an external root. The
+// signed certificate is then used as -ca-cert.
+func makeCACSR(ctx context.Context, keyFile, csrFile string) error {
+	if strings.TrimSpace(caName) == "" && !allowEmptyCAName {
+		return usageErrorf("refusing to create a CA with an empty subject; set -ca-name, or pass -allow-empty-ca-name if that's really wanted")
+	}
+	if err := checkSigningKeyType(flagKeyType()); err != nil {
+		return err
+	}
+	bc, err := asn1.Marshal(struct {
+		IsCA       bool `asn1:"optional"`
+		MaxPathLen int  `asn1:"optional,default:-1"`
+	}{true, intermediatePathLen})
+	if err != nil {
+		return err
+	}
+	// keyCertSign and cRLSign are bits 5 and 6.
+	ku, err := asn1.Marshal(asn1.BitString{Bytes: []byte{0x06}, BitLength: 7})
+	if err != nil {
+		return err
+	}
+	key, err := makeKey(ctx, keyFile, caKeyPassword, nil, flagKeyType())
+	if err != nil {
+		return err
+	}
+	policyExts, err := caPolicyExtensions()
+	if err != nil {
+		return err
+	}
+	template := &x509.CertificateRequest{
+		Subject: pkix.Name{CommonName: caName},
+		ExtraExtensions: append([]pkix.Extension{
+			{Id: oidBasicConstraints, Critical: true, Value: bc},
+			{Id: oidKeyUsage, Critical: true, Value: ku},
+		}, policyExts...),
+	}
+	der, err := x509.CreateCertificateRequest(signingRandom(), template, key)
+	if err != nil {
+		return err
+	}
+	return writePEM(csrFile, &pem.Block{
+		Type:  "CERTIFICATE REQUEST",
+		Bytes: der,
+	})
+}
+
+// compatNotice explains which clients can't verify certificates issued by a
+// newly created CA with the given key.
+func compatNotice(key interface{}) {
+	var notice string
+	switch k := key.(type) {
+	case ed25519.PrivateKey:
+		notice = "Ed25519 CA: many TLS clients, including older browsers, Java before 15 and " +
+			"OpenSSL before 1.1.1, can't verify Ed25519 signatures."
+	case *ecdsa.PrivateKey:
+		if k.Curve == elliptic.P521() {
+			notice = "P-521 CA: some TLS clients, including Chrome and BoringSSL based stacks, " +
+				"don't support P-521 signatures."
 		}
 	}
+	if notice != "" {
+		log.Printf("note: %s Certificates it issues may fail to verify on those clients. "+
+			"Use -ack-compat to silence this notice.", notice)
+	}
+}
 
+// createFile creates filename for writing with exactly the permissions perm,
+// regardless of the umask. Existing files are only replaced when overwrite is
+// set.
+func createFile(filename string, perm os.FileMode) (*os.File, error) {
+	flags := os.O_CREATE | os.O_EXCL | os.O_WRONLY
+	if overwrite {
+		flags = os.O_CREATE | os.O_TRUNC | os.O_WRONLY
+	}
+	file, err := os.OpenFile(filename, flags, perm)
 	if err != nil {
 		return nil, err
 	}
+	if err := file.Chmod(perm); err != nil {
+		file.Close()
+		return nil, err
+	}
+	return file, nil
+}
+
+// ecdsaCurves lists the values accepted by -ecdsa-curve.
+var ecdsaCurves = []struct {
+	name  string
+	curve elliptic.Curve // nil if recognized but not built in
+	note  string
+}{
+	{"P224", elliptic.P224(), "rarely supported by TLS clients"},
+	{"P256", elliptic.P256(), "default, supported by all modern TLS clients"},
+	{"P384", elliptic.P384(), "widely supported"},
+	{"P521", elliptic.P521(), "not supported by Chrome and other BoringSSL based clients"},
+	// nil when built with the nosecp256k1 tag.
+	{"secp256k1", secp256k1Curve, "leaf keys only; not accepted by TLS stacks, for custom protocols"},
+}
+
+// listKeyTypes prints the supported key types with compatibility notes.
+func listKeyTypes(out io.Writer) error {
+	w := tabwriter.NewWriter(out, 0, 0, 2, ' ', 0)
+	fmt.Fprintf(w, "Key type\tFlags\tNotes\n")
+	for _, c := range ecdsaCurves {
+		fmt.Fprintf(w, "ECDSA %s\t-ecdsa-curve %s\t%s\n", c.name, c.name, c.note)
+	}
+	fmt.Fprintf(w, "RSA\t-rsa -rsa-bits N\tsupported everywhere; 4096 bits by default, use at least 2048\n")
+	fmt.Fprintf(w, "Ed25519\t-ed25519\tnot supported by older browsers, Java before 15 or OpenSSL before 1.1.1\n")
+	return w.Flush()
+}
+
+// keyType describes a kind of private key to generate.
+type keyType struct {
+	algorithm string // "ecdsa", "rsa" or "ed25519"
+	rsaBits   int
+	curve     string
+}
+
+// flagKeyType returns the key type selected by the key flags.
+func flagKeyType() keyType {
+	kt := keyType{algorithm: "ecdsa", rsaBits: rsaBits, curve: ecdsaCurve}
+	if ed25519Key {
+		kt.algorithm = "ed25519"
+	} else if rsaKey {
+		kt.algorithm = "rsa"
+	}
+	return kt
+}
+
+// generateKey generates a private key of type kt.
+func generateKey(kt keyType) (crypto.PrivateKey, error) {
+	if kt.algorithm == "ed25519" {
+		_, key, err := ed25519.GenerateKey(random)
+		return key, err
+	} else if kt.algorithm == "rsa" {
+		if seeded || rsaExponent != 65537 {
+			return rsaKeyFromReader(random, kt.rsaBits, rsaExponent)
+		}
+		return rsa.GenerateKey(random, kt.rsaBits)
+	}
+	var curve elliptic.Curve
+	found := false
+	for _, c := range ecdsaCurves {
+		if c.name == kt.curve {
+			curve, found = c.curve, true
+		}
+	}
+	if !found {
+		return nil, usageErrorf("unrecognized curve: %q", kt.curve)
+	} else if curve == nil {
+		return nil, usageErrorf("%s is not supported: microca was built with the no%s tag", kt.curve, kt.curve)
+	}
+	if seeded {
+		return deterministicECDSAKey(curve, random)
+	}
+	return ecdsa.GenerateKey(curve, random)
+}
 
-	der, err = x509.MarshalPKCS8PrivateKey(key)
+// writeFile writes data to a new file named filename.
+func writeFile(filename string, data []byte) error {
+	if archive != nil {
+		return archive.add(filename, 0600, data)
+	}
+	file, err := createFile(filename, 0600)
 	if err != nil {
-		return nil, err
+		return err
+	}
+	_, err = file.Write(data)
+	if err != nil {
+		file.Close()
+		return err
+	}
+	return file.Close()
+}
+
+// encodePEM encodes block in PEM, wrapped at 64 characters. With
+// -pem-strict any headers are dropped and the result ends in exactly one
+// newline, for parsers that are picky about formatting.
+func encodePEM(block *pem.Block) []byte {
+	if pemStrict {
+		b := *block
+		b.Headers = nil
+		block = &b
+	}
+	out := pem.EncodeToMemory(block)
+	if pemStrict {
+		out = append(bytes.TrimRight(out, "\n"), '\n')
+	}
+	return out
+}
+
+// writePEM writes block to a new file named filename.
+func writePEM(filename string, block *pem.Block) error {
+	return writeFile(filename, encodePEM(block))
+}
+
+// makeKey generates a private key of type kt and writes it to filename, encrypted with
+// password unless it's nil. Generation is abandoned if ctx is done first, or
+// if it takes longer than -timeout.
+func makeKey(ctx context.Context, filename string, password []byte, recipients []string, kt keyType) (interface{}, error) {
+	if keygenTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, keygenTimeout)
+		defer cancel()
+	}
+	type result struct {
+		key crypto.PrivateKey
+		err error
 	}
+	done := make(chan result, 1)
+	go func() {
+		key, err := generateKey(kt)
+		done <- result{key, err}
+	}()
 
-	file, err := os.OpenFile(filename, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0600)
+	var key crypto.PrivateKey
+	select {
+	case r := <-done:
+		if r.err != nil {
+			return nil, r.err
+		}
+		key = r.key
+	case <-ctx.Done():
+		return nil, fmt.Errorf("generating key for %s: %s", filename, ctx.Err())
+	}
+
+	der, err := marshalPKCS8PrivateKey(key)
 	if err != nil {
 		return nil, err
 	}
-	defer file.Close()
-	err = pem.Encode(file, &pem.Block{
-		Type:  "PRIVATE KEY",
+	blockType := "PRIVATE KEY"
+	if password != nil {
+		der, err = encryptPKCS8(der, password)
+		if err != nil {
+			return nil, err
+		}
+		blockType = "ENCRYPTED PRIVATE KEY"
+	}
+
+	data := encodePEM(&pem.Block{
+		Type:  blockType,
 		Bytes: der,
 	})
+	if len(recipients) > 0 {
+		data, err = ageEncrypt(data, recipients)
+		if err != nil {
+			return nil, err
+		}
+	}
+	err = writeFile(filename, data)
 	if err != nil {
 		return nil, err
 	}
@@ -176,7 +838,7 @@ func makeKey(filename string) (interface{}, error) {
 }
 
 func makeRootCert(key interface{}, filename string) (*x509.Certificate, error) {
-	serial, err := rand.Int(rand.Reader, big.NewInt(math.MaxInt64))
+	serial, err := randomSerial()
 	if err != nil {
 		return nil, err
 	}
@@ -187,13 +849,14 @@ func makeRootCert(key interface{}, filename string) (*x509.Certificate, error) {
 	if err != nil {
 		return nil, err
 	}
+	notBefore, notAfter := roundValidity(now(), now().AddDate(100, 0, 0))
 	template := &x509.Certificate{
 		Subject: pkix.Name{
 			CommonName: caName,
 		},
 		SerialNumber: serial,
-		NotBefore:    time.Now(),
-		NotAfter:     time.Now().AddDate(100, 0, 0),
+		NotBefore:    notBefore,
+		NotAfter:     notAfter,
 
 		SubjectKeyId:          skid,
 		AuthorityKeyId:        skid,
@@ -202,18 +865,24 @@ func makeRootCert(key interface{}, filename string) (*x509.Certificate, error) {
 		BasicConstraintsValid: true,
 		IsCA:                  true,
 		MaxPathLenZero:        true,
-	}
 
-	der, err := x509.CreateCertificate(rand.Reader, template, template, pubKey, key)
+		DNSNames: caDNS,
+		URIs:     caURIs,
+	}
+	if intermediatePathLen > 0 {
+		template.MaxPathLen = intermediatePathLen
+		template.MaxPathLenZero = false
+	}
+	template.ExtraExtensions, err = caPolicyExtensions()
 	if err != nil {
 		return nil, err
 	}
-	file, err := os.OpenFile(filename, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0600)
+
+	der, err := x509.CreateCertificate(signingRandom(), template, template, pubKey, certSigner(key))
 	if err != nil {
 		return nil, err
 	}
-	defer file.Close()
-	err = pem.Encode(file, &pem.Block{
+	err = writePEM(filename, &pem.Block{
 		Type:  "CERTIFICATE",
 		Bytes: der,
 	})
@@ -228,19 +897,31 @@ func parseIPs(ipAddresses []string) ([]net.IP, error) {
 	for _, s := range ipAddresses {
 		p := net.ParseIP(s)
 		if p == nil {
-			return nil, fmt.Errorf("invalid IP address %s", s)
+			return nil, usageErrorf("invalid IP address %s", s)
+		}
+		// net.ParseIP returns IPv4 addresses in their 16 byte IPv4-in-IPv6
+		// form. Some validators reject that encoding in the iPAddress SAN,
+		// so always use the 4 byte form. crypto/x509 does this too, but
+		// don't rely on it.
+		if p4 := p.To4(); p4 != nil {
+			p = p4
 		}
 		parsed = append(parsed, p)
 	}
 	return parsed, nil
 }
 
+// publicKeysEqual reports whether a and b are the same key. Keys are compared
+// by value, so an ECDSA key matches however its point was encoded.
 func publicKeysEqual(a, b interface{}) (bool, error) {
-	aBytes, err := x509.MarshalPKIXPublicKey(a)
+	if k, ok := a.(interface{ Equal(crypto.PublicKey) bool }); ok {
+		return k.Equal(b), nil
+	}
+	aBytes, err := marshalPKIXPublicKey(a)
 	if err != nil {
 		return false, err
 	}
-	bBytes, err := x509.MarshalPKIXPublicKey(b)
+	bBytes, err := marshalPKIXPublicKey(b)
 	if err != nil {
 		return false, err
 	}
@@ -248,7 +929,7 @@ func publicKeysEqual(a, b interface{}) (bool, error) {
 }
 
 func calculateSKID(pubKey crypto.PublicKey) ([]byte, error) {
-	spkiASN1, err := x509.MarshalPKIXPublicKey(pubKey)
+	spkiASN1, err := marshalPKIXPublicKey(pubKey)
 	if err != nil {
 		return nil, err
 	}
@@ -277,93 +958,1677 @@ func publicKey(privKey interface{}) interface{} {
 	return nil
 }
 
-func sign(iss *issuer, domains []string, ipAddresses []string) (*x509.Certificate, error) {
-	var cn string
-	if len(domains) > 0 {
-		cn = domains[0]
-	} else if len(ipAddresses) > 0 {
-		cn = ipAddresses[0]
-	} else {
-		return nil, fmt.Errorf("must specify at least one domain name or IP address")
-	}
-	var cnFolder = strings.Replace(cn, "*", "_", -1)
-	err := os.Mkdir(cnFolder, 0700)
-	if err != nil && !os.IsExist(err) {
-		return nil, err
-	}
-	key, err := makeKey(fmt.Sprintf("%s/key.pem", cnFolder))
-	if err != nil {
-		return nil, err
-	}
-	pubKey := publicKey(key)
-	parsedIPs, err := parseIPs(ipAddresses)
-	if err != nil {
-		return nil, err
+var oidBasicConstraints = asn1.ObjectIdentifier{2, 5, 29, 19}
+
+// nonCriticalBasicConstraints returns a non-critical BasicConstraints
+// extension for an end-entity certificate.
+func nonCriticalBasicConstraints() (pkix.Extension, error) {
+	var bc struct {
+		IsCA bool `asn1:"optional"`
 	}
-	serial, err := rand.Int(rand.Reader, big.NewInt(math.MaxInt64))
+	value, err := asn1.Marshal(bc)
 	if err != nil {
-		return nil, err
+		return pkix.Extension{}, err
 	}
-	template := &x509.Certificate{
-		DNSNames:    domains,
-		IPAddresses: parsedIPs,
-		Subject: pkix.Name{
-			CommonName: cn,
-		},
-		SerialNumber: serial,
-		NotBefore:    time.Now(),
-		// Set the validity period to 2 years and 30 days, to satisfy the iOS and
-		// macOS requirements that all server certificates must have validity
-		// shorter than 825 days:
-		// https://derflounder.wordpress.com/2019/06/06/new-tls-security-requirements-for-ios-13-and-macos-catalina-10-15/
-		NotAfter: time.Now().AddDate(2, 0, 30),
+	return pkix.Extension{Id: oidBasicConstraints, Critical: false, Value: value}, nil
+}
 
-		KeyUsage:              x509.KeyUsageDigitalSignature,
-		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
-		BasicConstraintsValid: true,
-		IsCA:                  false,
-	}
+var (
+	oidNTDSCASecurityExt = asn1.ObjectIdentifier{1, 3, 6, 1, 4, 1, 311, 25, 2}
+	oidNTDSObjectSID     = asn1.ObjectIdentifier{1, 3, 6, 1, 4, 1, 311, 25, 2, 1}
+)
 
-	if !ed25519Key && ecdsaCurve == "" {
-		template.KeyUsage |= x509.KeyUsageKeyEncipherment
-	}
+var sidRe = regexp.MustCompile(`^S-1-[0-9]+(-[0-9]+)+$`)
 
-	der, err := x509.CreateCertificate(rand.Reader, template, iss.cert, pubKey, iss.key)
+// msSIDExtension returns the Active Directory security identifier extension
+// used for strong certificate mapping (KB5014754). Its OID is
+// 1.3.6.1.4.1.311.25.2 and its value is a SEQUENCE of one GeneralName, an
+// otherName of type 1.3.6.1.4.1.311.25.2.1 holding the SID string, such as
+// S-1-5-21-..., as an [0] EXPLICIT OCTET STRING.
+func msSIDExtension(sid string) (pkix.Extension, error) {
+	typeID, err := asn1.Marshal(oidNTDSObjectSID)
 	if err != nil {
-		return nil, err
+		return pkix.Extension{}, err
 	}
-	file, err := os.OpenFile(fmt.Sprintf("%s/cert.pem", cnFolder), os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0600)
+	value, err := asn1.MarshalWithParams([]byte(sid), "tag:0,explicit")
 	if err != nil {
-		return nil, err
+		return pkix.Extension{}, err
 	}
-	defer file.Close()
-	err = pem.Encode(file, &pem.Block{
-		Type:  "CERTIFICATE",
-		Bytes: der,
-	})
+	otherName := asn1.RawValue{
+		Class:      asn1.ClassContextSpecific,
+		Tag:        0,
+		IsCompound: true,
+		Bytes:      append(typeID, value...),
+	}
+	ext, err := asn1.Marshal([]asn1.RawValue{otherName})
 	if err != nil {
-		return nil, err
+		return pkix.Extension{}, err
 	}
-	return x509.ParseCertificate(der)
+	return pkix.Extension{Id: oidNTDSCASecurityExt, Value: ext}, nil
+}
+
+var (
+	oidPolicyConstraints = asn1.ObjectIdentifier{2, 5, 29, 36}
+	oidInhibitAnyPolicy  = asn1.ObjectIdentifier{2, 5, 29, 54}
+)
+
+// caPolicyExtensions returns the policyConstraints and inhibitAnyPolicy
+// extensions (RFC 5280, sections 4.2.1.11 and 4.2.1.14) for a new CA, as
+// set by -ca-require-explicit-policy, -ca-inhibit-policy-mapping and
+// -ca-inhibit-any-policy. Each value is a number of certificates to skip;
+// -1 leaves the constraint out. Both extensions must be critical.
+func caPolicyExtensions() ([]pkix.Extension, error) {
+	var exts []pkix.Extension
+	if requireExplicitPolicy >= 0 || inhibitPolicyMapping >= 0 {
+		value, err := asn1.Marshal(struct {
+			RequireExplicitPolicy int `asn1:"optional,tag:0,default:-1"`
+			InhibitPolicyMapping  int `asn1:"optional,tag:1,default:-1"`
+		}{requireExplicitPolicy, inhibitPolicyMapping})
+		if err != nil {
+			return nil, err
+		}
+		exts = append(exts, pkix.Extension{Id: oidPolicyConstraints, Critical: true, Value: value})
+	}
+	if inhibitAnyPolicy >= 0 {
+		value, err := asn1.Marshal(inhibitAnyPolicy)
+		if err != nil {
+			return nil, err
+		}
+		exts = append(exts, pkix.Extension{Id: oidInhibitAnyPolicy, Critical: true, Value: value})
+	}
+	return exts, nil
+}
+
+var oidOCSPNoCheck = asn1.ObjectIdentifier{1, 3, 6, 1, 5, 5, 7, 48, 1, 5}
+
+// ocspNoCheck returns the id-pkix-ocsp-nocheck extension (RFC 6960,
+// section 4.2.2.2.1), telling clients not to check the revocation status
+// of an OCSP responder certificate.
+func ocspNoCheck() pkix.Extension {
+	return pkix.Extension{Id: oidOCSPNoCheck, Value: asn1.NullBytes}
+}
+
+var oidTLSFeature = asn1.ObjectIdentifier{1, 3, 6, 1, 5, 5, 7, 1, 24}
+
+// mustStaple returns the TLS Feature extension (RFC 7633) listing
+// status_request (5), known as OCSP must-staple. Clients honoring it reject
+// the certificate unless the server staples a valid OCSP response.
+func mustStaple() (pkix.Extension, error) {
+	value, err := asn1.Marshal([]int{5})
+	if err != nil {
+		return pkix.Extension{}, err
+	}
+	return pkix.Extension{Id: oidTLSFeature, Value: value}, nil
+}
+
+var oidNetscapeCertType = asn1.ObjectIdentifier{2, 16, 840, 1, 113730, 1, 1}
+
+// netscapeCertTypes are the bits of the Netscape certificate type
+// extension, numbered from the most significant bit. Bit 4 is reserved.
+var netscapeCertTypes = map[string]int{
+	"client":  0,
+	"server":  1,
+	"email":   2,
+	"objsign": 3,
+	"sslCA":   5,
+	"emailCA": 6,
+	"objCA":   7,
+}
+
+// netscapeCertType returns the deprecated Netscape certificate type
+// extension with the given types set, for -netscape-cert-type.
+func netscapeCertType(types []string) (pkix.Extension, error) {
+	var bits byte
+	length := 0
+	for _, t := range types {
+		bit, ok := netscapeCertTypes[t]
+		if !ok {
+			return pkix.Extension{}, usageErrorf("unknown -netscape-cert-type %q, expected client, server, email, objsign, sslCA, emailCA or objCA", t)
+		}
+		bits |= 0x80 >> uint(bit)
+		if bit+1 > length {
+			length = bit + 1
+		}
+	}
+	// DER drops trailing zero bits, so the length ends at the last type set.
+	value, err := asn1.Marshal(asn1.BitString{Bytes: []byte{bits}, BitLength: length})
+	if err != nil {
+		return pkix.Extension{}, err
+	}
+	return pkix.Extension{Id: oidNetscapeCertType, Value: value}, nil
+}
+
+// randomSerial returns a random positive certificate serial number.
+func randomSerial() (*big.Int, error) {
+	if serialMode == "timestamp" {
+		return timestampSerial()
+	}
+	if browserCompat {
+		// The CA/Browser Forum baseline requires at least 64 bits of
+		// entropy, more than the 63 of the default, so use 127.
+		return rand.Int(random, new(big.Int).Lsh(big.NewInt(1), 127))
+	}
+	return rand.Int(random, big.NewInt(math.MaxInt64))
+}
+
+// timestampSerial returns a serial number for -serial-mode timestamp: the
+// issue time in nanoseconds in the high 64 bits, so serials sort in issue
+// order, and 64 random bits below it. The result is positive and less than
+// 2^127, well within the 20 octets RFC 5280 allows.
+func timestampSerial() (*big.Int, error) {
+	low := make([]byte, 8)
+	if _, err := io.ReadFull(random, low); err != nil {
+		return nil, err
+	}
+	serial := new(big.Int).SetInt64(now().UnixNano())
+	serial.Lsh(serial, 64)
+	return serial.Or(serial, new(big.Int).SetBytes(low)), nil
+}
+
+// maxBrowserValidity is the longest leaf validity browsers accept.
+const maxBrowserValidity = 397 * 24 * time.Hour
+
+// leafValidity returns the validity period of a leaf certificate issued at
+// now, lasting for validity or the default period if validity is zero. The
+// period starts -backdate before now and its length is measured from that
+// start. With -expired or -future the period is shifted so the certificate
+// is already expired or not yet valid.
+func leafValidity(now time.Time, validity time.Duration) (notBefore, notAfter time.Time) {
+	notBefore = now.Add(-backdate)
+	if validity > 0 {
+		notAfter = notBefore.Add(validity)
+	} else {
+		// Set the validity period to 2 years and 30 days, to satisfy the iOS and
+		// macOS requirements that all server certificates must have validity
+		// shorter than 825 days:
+		// https://derflounder.wordpress.com/2019/06/06/new-tls-security-requirements-for-ios-13-and-macos-catalina-10-15/
+		notAfter = notBefore.AddDate(2, 0, 30)
+	}
+	lifetime := notAfter.Sub(notBefore)
+	if expired {
+		notAfter = now.Add(-24 * time.Hour)
+		notBefore = notAfter.Add(-lifetime)
+	} else if future {
+		notBefore = now.Add(24 * time.Hour)
+		notAfter = notBefore.Add(lifetime)
+	}
+	return roundValidity(notBefore, notAfter)
+}
+
+// roundValidity rounds notBefore down to -time-granularity, for validators
+// that flag odd seconds in the validity period, and moves notAfter back by
+// the same amount so the period keeps its exact length. notAfter is then
+// rounded too whenever the length is a whole multiple of the granularity.
+func roundValidity(notBefore, notAfter time.Time) (time.Time, time.Time) {
+	if timeGranularity <= 0 {
+		return notBefore, notAfter
+	}
+	rounded := notBefore.Truncate(timeGranularity)
+	return rounded, notAfter.Add(-notBefore.Sub(rounded))
+}
+
+// leafSpec describes a leaf certificate to issue.
+type leafSpec struct {
+	commonName  string // defaults to the first domain name or IP address
+	folder      string // defaults to a folder named after the Common Name
+	domains     []string
+	ipAddresses []string
+	validity    time.Duration // zero for the default validity
+	keyType     *keyType      // nil for the type chosen by the key flags
+	serial      *big.Int      // nil for a new serial number
+
+	// unicodeDomains are the Unicode forms of internationalized domains,
+	// also included as SANs with -idn-both.
+	unicodeDomains []string
+
+	// pubKey is the public key to certify. If nil, a new key is generated
+	// and written alongside the certificate.
+	pubKey crypto.PublicKey
+
+	// certPath and keyPath are where sign wrote the leaf certificate and
+	// where its key is kept.
+	certPath string
+	keyPath  string
+}
+
+// parseLeafSpec parses a -cert value such as
+// "domains=a.com,b.com;ip=10.0.0.1;validity=90d".
+func parseLeafSpec(s string) (*leafSpec, error) {
+	spec := &leafSpec{}
+	kt := flagKeyType()
+	var setBits, setCurve bool
+	for _, field := range strings.Split(s, ";") {
+		if field == "" {
+			continue
+		}
+		i := strings.Index(field, "=")
+		if i < 0 {
+			return nil, usageErrorf("invalid -cert field %q, expected key=value", field)
+		}
+		key, value := field[:i], field[i+1:]
+		switch key {
+		case "domains":
+			spec.domains = append(spec.domains, split(value)...)
+		case "ip", "ip-addresses":
+			spec.ipAddresses = append(spec.ipAddresses, split(value)...)
+		case "validity":
+			d, err := parseValidity(value)
+			if err != nil {
+				return nil, err
+			}
+			spec.validity = d
+		case "key":
+			switch value {
+			case "ecdsa", "rsa", "ed25519":
+			default:
+				return nil, usageErrorf("invalid -cert key %q, expected ecdsa, rsa or ed25519", value)
+			}
+			kt.algorithm = value
+			spec.keyType = &kt
+		case "bits":
+			bits, err := strconv.Atoi(value)
+			if err != nil || bits < 1024 {
+				return nil, usageErrorf("invalid -cert bits %q", value)
+			}
+			kt.rsaBits, setBits = bits, true
+			spec.keyType = &kt
+		case "curve":
+			kt.curve, setCurve = value, true
+			spec.keyType = &kt
+		default:
+			return nil, usageErrorf("unknown -cert field %q", key)
+		}
+	}
+	if len(spec.domains) == 0 && len(spec.ipAddresses) == 0 {
+		return nil, usageErrorf("-cert %q has no domains or IP addresses", s)
+	}
+	if setBits && kt.algorithm != "rsa" {
+		return nil, usageErrorf("-cert %q sets bits, which needs key=rsa", s)
+	} else if setCurve && kt.algorithm != "ecdsa" {
+		return nil, usageErrorf("-cert %q sets curve, which needs key=ecdsa", s)
+	}
+	return spec, nil
+}
+
+// newKeyType returns the type of key to generate for spec.
+func (spec *leafSpec) newKeyType() keyType {
+	if spec.keyType != nil {
+		return *spec.keyType
+	}
+	return flagKeyType()
+}
+
+// parseValidity parses a validity period given either as a Go duration such
+// as "2160h" or as a number of days such as "90d".
+func parseValidity(s string) (time.Duration, error) {
+	var d time.Duration
+	var err error
+	if strings.HasSuffix(s, "d") {
+		var days int
+		days, err = strconv.Atoi(strings.TrimSuffix(s, "d"))
+		d = time.Duration(days) * 24 * time.Hour
+	} else {
+		d, err = time.ParseDuration(s)
+	}
+	if err != nil || d <= 0 {
+		return 0, usageErrorf("invalid validity %q, expected a positive duration such as 90d or 2160h", s)
+	}
+	return d, nil
+}
+
+// checkOnion reports an error if domain, which ends in .onion, isn't a v3
+// onion service address or a subdomain of one. The address is 56 base32
+// characters encoding the service's public key, a checksum and the version
+// 3. The checksum isn't verified.
+func checkOnion(domain string) error {
+	labels := strings.Split(strings.ToLower(strings.TrimSuffix(domain, ".")), ".")
+	if len(labels) < 2 {
+		return usageErrorf("invalid onion address %q", domain)
+	}
+	addr := labels[len(labels)-2]
+	if len(addr) != 56 {
+		return usageErrorf("invalid onion address %q: %q must be 56 characters, not %d (v2 addresses are not supported)",
+			domain, addr, len(addr))
+	}
+	decoded, err := base32.StdEncoding.DecodeString(strings.ToUpper(addr))
+	if err != nil {
+		return usageErrorf("invalid onion address %q: %q is not base32", domain, addr)
+	}
+	if version := decoded[len(decoded)-1]; version != 3 {
+		return usageErrorf("invalid onion address %q: version %d, expected 3", domain, version)
+	}
+	return nil
+}
+
+// checkHostname reports an error if domain isn't a valid hostname under
+// RFC 1035 and RFC 6125: at most 253 characters, no empty labels, labels
+// of at most 63 characters that don't start or end with a hyphen, and a
+// wildcard only as the whole leftmost label.
+func checkHostname(domain string) error {
+	if len(domain) > 253 {
+		return usageErrorf("invalid hostname %q: %d characters, the maximum is 253", domain, len(domain))
+	}
+	labels := strings.Split(domain, ".")
+	for i, label := range labels {
+		switch {
+		case label == "":
+			return usageErrorf("invalid hostname %q: empty label (leading, trailing or consecutive dots)", domain)
+		case len(label) > 63:
+			return usageErrorf("invalid hostname %q: label %q is %d characters, the maximum is 63", domain, label, len(label))
+		case strings.HasPrefix(label, "-") || strings.HasSuffix(label, "-"):
+			return usageErrorf("invalid hostname %q: label %q starts or ends with a hyphen", domain, label)
+		case strings.Contains(label, "*") && (i != 0 || label != "*"):
+			return usageErrorf("invalid hostname %q: a wildcard must be the whole leftmost label", domain)
+		}
+	}
+	if labels[0] == "*" && len(labels) < 3 {
+		return usageErrorf("invalid hostname %q: a wildcard needs at least two labels after it", domain)
+	}
+	return nil
+}
+
+// validateSANs checks the domain names and IP addresses of spec. IP
+// addresses given as domain names are moved to the IP addresses, or
+// rejected with -strict.
+func validateSANs(spec *leafSpec, domainRe *regexp.Regexp) error {
+	var domains []string
+	for _, d := range spec.domains {
+		if net.ParseIP(d) != nil {
+			if strict {
+				return &sanError{d, usageErrorf("%q is an IP address, not a domain name; use -ip-addresses", d)}
+			}
+			log.Printf("warning: %q is an IP address, including it as an IP address rather than a domain name", d)
+			spec.ipAddresses = dedup(append(spec.ipAddresses, d))
+			continue
+		}
+		domains = append(domains, d)
+	}
+	for i, d := range domains {
+		if isASCII(d) {
+			continue
+		}
+		ascii, err := idnToASCII(d)
+		if err != nil {
+			return &sanError{d, err}
+		}
+		if idnBoth {
+			spec.unicodeDomains = append(spec.unicodeDomains, d)
+		}
+		domains[i] = ascii
+	}
+	spec.domains = dedup(domains)
+	for _, d := range spec.domains {
+		if err := checkDomain(d, domainRe); err != nil {
+			return &sanError{d, err}
+		}
+	}
+	var ips []string
+	for _, ip := range spec.ipAddresses {
+		p := net.ParseIP(ip)
+		if p == nil {
+			return &sanError{ip, usageErrorf("invalid IP address %q", ip)}
+		}
+		if ipv4Only && p.To4() == nil || ipv6Only && p.To4() != nil {
+			continue
+		}
+		ips = append(ips, ip)
+	}
+	if len(ips) == 0 && len(spec.ipAddresses) > 0 && len(spec.domains) == 0 {
+		family := "IPv4"
+		if ipv6Only {
+			family = "IPv6"
+		}
+		return usageErrorf("none of the IP addresses %s is %s, leaving no Subject Alternative Names", strings.Join(spec.ipAddresses, ", "), family)
+	}
+	spec.ipAddresses = ips
+	return nil
+}
+
+// checkExactSNI makes sure specs describe a single certificate for exactly
+// the fully qualified hostname name, for -exact-sni.
+func checkExactSNI(name string, specs []*leafSpec) error {
+	if noSAN {
+		return usageErrorf("-exact-sni names the certificate by its Subject Alternative Name and can't be combined with -no-san")
+	}
+	if strings.Contains(name, "*") {
+		return &sanError{name, usageErrorf("-exact-sni %q must not be a wildcard", name)}
+	}
+	if err := checkHostname(strings.TrimSuffix(name, ".")); err != nil {
+		return &sanError{name, err}
+	}
+	if !strings.Contains(strings.TrimSuffix(name, "."), ".") {
+		return &sanError{name, usageErrorf("-exact-sni %q must be a fully qualified hostname", name)}
+	}
+	for _, spec := range specs {
+		for _, d := range spec.domains {
+			if d != name {
+				return &sanError{d, usageErrorf("-exact-sni %s allows no other names, but %s was also given", name, d)}
+			}
+		}
+		if len(spec.ipAddresses) > 0 {
+			return &sanError{spec.ipAddresses[0], usageErrorf("-exact-sni %s allows no other names, but IP address %s was also given", name, spec.ipAddresses[0])}
+		}
+		if len(spec.domains) == 0 {
+			return usageErrorf("-exact-sni %s must be the certificate's name", name)
+		}
+	}
+	return nil
+}
+
+// checkDomain checks a domain name given for a Subject Alternative Name.
+func checkDomain(d string, domainRe *regexp.Regexp) error {
+	if !domainRe.MatchString(d) {
+		return usageErrorf("invalid domain name %q (does not match %s)", d, domainRe)
+	}
+	if strictHostnames {
+		if err := checkHostname(d); err != nil {
+			return err
+		}
+	}
+	if strings.HasSuffix(strings.ToLower(strings.TrimSuffix(d, ".")), ".onion") {
+		return checkOnion(d)
+	}
+	return nil
+}
+
+// leafName returns the Common Name for the leaf described by spec and the
+// folder its files are written to.
+func leafName(spec *leafSpec) (cn string, cnFolder string, err error) {
+	if spec.commonName != "" {
+		cn = spec.commonName
+	} else if len(spec.domains) > 0 {
+		cn = spec.domains[0]
+	} else if len(spec.ipAddresses) > 0 {
+		cn = spec.ipAddresses[0]
+	} else {
+		return "", "", usageErrorf("must specify at least one domain name or IP address")
+	}
+	if cn == "." || cn == ".." || strings.ContainsAny(cn, `/\`) {
+		return "", "", usageErrorf("invalid Common Name %q, it must be usable as a folder name", cn)
+	}
+	name := strings.Replace(cn, "*", "_", -1)
+	if folderHash {
+		name += "-" + sanSetHash(spec)
+	}
+	cnFolder = filepath.Join(outputDir, name)
+	if spec.folder != "" {
+		cnFolder = spec.folder
+	} else if noDir {
+		cnFolder = outputDir
+		if cnFolder == "" {
+			cnFolder = "."
+		}
+	}
+	return cn, cnFolder, nil
+}
+
+// leafFolder returns the Common Name for the leaf described by spec and
+// creates the folder its files are written to.
+func leafFolder(spec *leafSpec) (cn string, cnFolder string, err error) {
+	cn, cnFolder, err = leafName(spec)
+	if err != nil || noDir && spec.folder == "" || archive != nil {
+		return cn, cnFolder, err
+	}
+	err = os.Mkdir(cnFolder, 0700)
+	if err == nil {
+		// Mkdir is subject to the umask.
+		err = os.Chmod(cnFolder, 0700)
+	}
+	if os.IsExist(err) {
+		if info, statErr := os.Stat(cnFolder); statErr == nil && !info.IsDir() {
+			return "", "", &exitError{exitExists, fmt.Errorf("%s exists and is not a folder, so the leaf files can't be written there", cnFolder)}
+		}
+		if spec.folder == "" {
+			if err := checkFolderOwner(cnFolder, cn); err != nil {
+				return "", "", err
+			}
+		}
+	} else if err != nil {
+		return "", "", err
+	}
+	return cn, cnFolder, nil
+}
+
+// sanSetHash returns a short hash of the Common Name and the full set of
+// Subject Alternative Names in spec, in any order, for -folder-hash.
+func sanSetHash(spec *leafSpec) string {
+	names := append(append([]string{}, spec.domains...), spec.ipAddresses...)
+	sort.Strings(names)
+	h := sha256.New()
+	fmt.Fprintf(h, "%s\n", spec.commonName)
+	for _, n := range names {
+		fmt.Fprintf(h, "%s\n", n)
+	}
+	return hex.EncodeToString(h.Sum(nil))[:8]
+}
+
+// checkFolderOwner refuses to reuse a leaf folder that already holds a
+// certificate for a different name. Both "*.example.com" and
+// "_.example.com" map to the folder "_.example.com".
+func checkFolderOwner(cnFolder, cn string) error {
+	certContents, err := ioutil.ReadFile(filepath.Join(cnFolder, leafCertName()))
+	if err != nil {
+		return nil
+	}
+	cert, err := parseCert(certContents)
+	if err != nil {
+		return nil
+	}
+	if cert.Subject.CommonName == cn {
+		return nil
+	}
+	for _, name := range cert.DNSNames {
+		if name == cn {
+			return nil
+		}
+	}
+	for _, ip := range cert.IPAddresses {
+		if ip.String() == cn {
+			return nil
+		}
+	}
+	return &exitError{exitExists, fmt.Errorf("%s already holds a certificate for %q, not %q; use -folder-hash to give each name its own folder", cnFolder, cert.Subject.CommonName, cn)}
+}
+
+// removeLeafFolder removes a leaf folder left empty by a failure. With
+// -no-dir there's no folder of the leaf's own to remove.
+func removeLeafFolder(cnFolder string) {
+	if !noDir {
+		// Only removes the folder if it's empty.
+		os.Remove(cnFolder)
+	}
+}
+
+func leafSubject(cn string) pkix.Name {
+	if grpcProfile {
+		// gRPC clients match only SANs; an empty subject makes sure
+		// nothing falls back to the Common Name.
+		cn = ""
+	}
+	return pkix.Name{
+		CommonName:   cn,
+		SerialNumber: subjectSerial,
+		ExtraNames:   subjectExtra,
+	}
+}
+
+// makeCSR generates a leaf key and a certificate signing request for it, to
+// be signed by a CA elsewhere with -csr.
+func makeCSR(ctx context.Context, spec *leafSpec) error {
+	cn, cnFolder, err := leafFolder(spec)
+	if err != nil {
+		return err
+	}
+	key, err := makeKey(ctx, filepath.Join(cnFolder, leafKeyName()), leafKeyPassword, keyRecipients, spec.newKeyType())
+	if err != nil {
+		removeLeafFolder(cnFolder)
+		return err
+	}
+	parsedIPs, err := parseIPs(spec.ipAddresses)
+	if err != nil {
+		return err
+	}
+	template := &x509.CertificateRequest{
+		Subject:    leafSubject(cn),
+		RawSubject: subjectDN,
+	}
+	if !noSAN {
+		template.DNSNames = spec.domains
+		template.IPAddresses = parsedIPs
+	}
+	der, err := x509.CreateCertificateRequest(signingRandom(), template, key)
+	if err != nil {
+		return err
+	}
+	return writePEM(fmt.Sprintf("%s/csr.pem", cnFolder), &pem.Block{
+		Type:  "CERTIFICATE REQUEST",
+		Bytes: der,
+	})
+}
+
+func readCSR(csrPath string) (*x509.CertificateRequest, error) {
+	csrContents, err := ioutil.ReadFile(csrPath)
+	if err != nil {
+		return nil, fmt.Errorf("reading certificate request from %s: %s", csrPath, err)
+	}
+	block, _ := pem.Decode(csrContents)
+	if block == nil {
+		return nil, fmt.Errorf("reading certificate request from %s: no PEM found", csrPath)
+	} else if block.Type != "CERTIFICATE REQUEST" {
+		return nil, fmt.Errorf("reading certificate request from %s: incorrect PEM type %s", csrPath, block.Type)
+	}
+	csr, err := x509.ParseCertificateRequest(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("reading certificate request from %s: %s", csrPath, err)
+	}
+	if err := csr.CheckSignature(); err != nil {
+		return nil, verifyErrorf("certificate request %s: %s", csrPath, err)
+	}
+	return csr, nil
+}
+
+// matchDomainConstraint reports whether domain falls within the DNS name
+// constraint, following RFC 5280: "example.com" matches the domain and its
+// subdomains while ".example.com" matches only subdomains. A wildcard
+// domain is treated like any other subdomain.
+func matchDomainConstraint(domain, constraint string) bool {
+	domain = strings.ToLower(strings.TrimSuffix(domain, "."))
+	constraint = strings.ToLower(constraint)
+	if strings.HasPrefix(constraint, ".") {
+		return strings.HasSuffix(domain, constraint)
+	}
+	return domain == constraint || strings.HasSuffix(domain, "."+constraint)
+}
+
+// checkNameConstraints reports an error if any of the SANs would violate the
+// name constraints of the CA certificate, which clients would reject.
+func checkNameConstraints(ca *x509.Certificate, domains []string, ipAddresses []net.IP) error {
+	for _, d := range domains {
+		for _, c := range ca.ExcludedDNSDomains {
+			if matchDomainConstraint(d, c) {
+				return usageErrorf("domain %q is excluded by the CA's name constraint %q", d, c)
+			}
+		}
+		if len(ca.PermittedDNSDomains) == 0 {
+			continue
+		}
+		permitted := false
+		for _, c := range ca.PermittedDNSDomains {
+			if matchDomainConstraint(d, c) {
+				permitted = true
+				break
+			}
+		}
+		if !permitted {
+			return usageErrorf("domain %q is not within the CA's permitted domains %s",
+				d, strings.Join(ca.PermittedDNSDomains, ", "))
+		}
+	}
+	for _, ip := range ipAddresses {
+		for _, r := range ca.ExcludedIPRanges {
+			if r.Contains(ip) {
+				return usageErrorf("IP address %s is excluded by the CA's name constraint %s", ip, r)
+			}
+		}
+		if len(ca.PermittedIPRanges) == 0 {
+			continue
+		}
+		permitted := false
+		for _, r := range ca.PermittedIPRanges {
+			if r.Contains(ip) {
+				permitted = true
+				break
+			}
+		}
+		if !permitted {
+			return usageErrorf("IP address %s is not within the CA's permitted IP ranges", ip)
+		}
+	}
+	return nil
+}
+
+// writeJWKs writes the leaf's public key to pub.jwk and, if known, its
+// private key to key.jwk.
+func writeJWKs(cnFolder string, key, pubKey interface{}) error {
+	pub, err := marshalJWK(pubKey)
+	if err != nil {
+		return err
+	}
+	err = writeFile(fmt.Sprintf("%s/pub.jwk", cnFolder), append(pub, '\n'))
+	if err != nil {
+		return err
+	}
+	if key == nil {
+		return nil
+	}
+	priv, err := marshalJWK(key)
+	if err != nil {
+		return err
+	}
+	return writeFile(fmt.Sprintf("%s/key.jwk", cnFolder), append(priv, '\n'))
+}
+
+// maxSANBytes is roughly where a Subject Alternative Name extension makes a
+// certificate too big for some TLS stacks to load.
+const maxSANBytes = 8192
+
+// checkSANCount enforces -max-sans and warns when a certificate would have
+// more than -warn-sans names or a very large Subject Alternative Name
+// extension.
+func checkSANCount(domains []string, ips []net.IP) error {
+	n := len(domains) + len(ips)
+	if maxSANs > 0 && n > maxSANs {
+		return usageErrorf("%d Subject Alternative Names exceeds -max-sans %d", n, maxSANs)
+	}
+	// Each name is encoded with a two byte tag and length, or four
+	// for names longer than 127 bytes.
+	size := 0
+	for _, d := range domains {
+		size += len(d) + 2
+		if len(d) > 127 {
+			size += 2
+		}
+	}
+	for _, ip := range ips {
+		size += len(ip) + 2
+	}
+	if warnSANs > 0 && n > warnSANs {
+		log.Printf("warning: certificate has %d Subject Alternative Names (about %d bytes); some servers and clients refuse certificates this large", n, size)
+	} else if size > maxSANBytes {
+		log.Printf("warning: Subject Alternative Names take about %d bytes; some servers and clients refuse certificates this large", size)
+	}
+	return nil
+}
+
+// writeBundle writes the given DER certificates to filename as a PKCS #7
+// bundle, after checking the bundle parses back to the same certificates,
+// in whatever order DER puts them.
+func writeBundle(filename string, certs ...[]byte) error {
+	p7, err := marshalPKCS7(certs...)
+	if err != nil {
+		return err
+	}
+	parsed, err := parsePKCS7(p7)
+	if err != nil {
+		return err
+	}
+	if len(parsed) != len(certs) {
+		return fmt.Errorf("PKCS #7 bundle holds %d certificates, expected %d", len(parsed), len(certs))
+	}
+	for i, der := range certs {
+		found := false
+		for _, cert := range parsed {
+			found = found || bytes.Equal(cert.Raw, der)
+		}
+		if !found {
+			return fmt.Errorf("PKCS #7 bundle is missing certificate %d", i)
+		}
+	}
+	return writeFile(filename, p7)
+}
+
+// runPostHook runs -post-hook with the shell, passing the paths of the
+// issued certificate and its key, if any, and its Subject Alternative Names
+// in MICROCA_CERT, MICROCA_KEY and MICROCA_SANS.
+func runPostHook(certPath, keyPath string, sans []string) error {
+	if _, err := os.Stat(keyPath); err != nil {
+		keyPath = ""
+	}
+	cmd := exec.Command("/bin/sh", "-c", postHook)
+	cmd.Env = append(os.Environ(),
+		"MICROCA_CERT="+certPath,
+		"MICROCA_KEY="+keyPath,
+		"MICROCA_SANS="+strings.Join(sans, ","))
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	err := cmd.Run()
+	if err != nil {
+		return fmt.Errorf("post-hook %q for %s: %s", postHook, certPath, err)
+	}
+	if verbose {
+		log.Printf("post-hook %q for %s: exit status 0", postHook, certPath)
+	}
+	return nil
+}
+
+// leafKeyName returns the file name of a leaf's private key.
+func leafKeyName() string {
+	name := "key.pem"
+	if keyFilename != "" {
+		name = keyFilename
+	} else if certbotLayout {
+		name = "privkey.pem"
+	}
+	if len(keyRecipients) > 0 {
+		name += ".age"
+	}
+	return name
+}
+
+// leafCertName returns the file name of a leaf certificate.
+func leafCertName() string {
+	if certFilename != "" {
+		return certFilename
+	}
+	return "cert.pem"
+}
+
+// sign issues the leaf certificate described by spec.
+func sign(ctx context.Context, iss *issuer, spec *leafSpec) (*x509.Certificate, error) {
+	parsedIPs, err := parseIPs(spec.ipAddresses)
+	if err != nil {
+		return nil, err
+	}
+	if !noSAN {
+		err = checkNameConstraints(iss.cert, spec.domains, parsedIPs)
+		if err != nil {
+			return nil, err
+		}
+		err = checkSANCount(spec.domains, parsedIPs)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if signatureAlgorithm != x509.UnknownSignatureAlgorithm {
+		err = checkSignatureAlgorithm(signatureAlgorithm, iss.key)
+		if err != nil {
+			return nil, err
+		}
+	}
+	cn, cnFolder, err := leafFolder(spec)
+	if err != nil {
+		return nil, err
+	}
+	var key interface{}
+	generated := false // whether this run wrote the key at keyPath
+	keyPath := filepath.Join(cnFolder, leafKeyName())
+	certPath := filepath.Join(cnFolder, leafCertName())
+	pubKey := spec.pubKey
+	if pubKey == nil && refresh {
+		keyContents, err := ioutil.ReadFile(keyPath)
+		if os.IsNotExist(err) {
+			removeLeafFolder(cnFolder)
+			return nil, usageErrorf("-refresh needs the existing key %s; issue without -refresh to generate a new key", keyPath)
+		} else if err != nil {
+			return nil, err
+		}
+		key, err = readPrivateKey(keyContents, leafKeyPassword)
+		if err != nil {
+			return nil, fmt.Errorf("reading private key from %s: %s", keyPath, err)
+		}
+		pubKey = publicKey(key)
+	} else if pubKey == nil {
+		key, err = makeKey(ctx, keyPath, leafKeyPassword, keyRecipients, spec.newKeyType())
+		if err != nil {
+			removeLeafFolder(cnFolder)
+			return nil, err
+		}
+		pubKey = publicKey(key)
+		generated = true
+	}
+	serial := spec.serial
+	if serial == nil {
+		serial, err = randomSerial()
+		if err != nil {
+			return nil, err
+		}
+	}
+	notBefore, notAfter := leafValidity(now(), spec.validity)
+	template := &x509.Certificate{
+		Subject:      leafSubject(cn),
+		RawSubject:   subjectDN,
+		SerialNumber: serial,
+		NotBefore:    notBefore,
+		NotAfter:     notAfter,
+
+		// Chain builders match the leaf's AuthorityKeyId against the
+		// CA's SubjectKeyId, so copy the CA's rather than deriving it
+		// from the key: imported CAs may use another derivation.
+		AuthorityKeyId:        iss.cert.SubjectKeyId,
+		IssuingCertificateURL: caIssuers,
+
+		KeyUsage:              x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  false,
+		SignatureAlgorithm:    signatureAlgorithm,
+	}
+	if cloneFrom != nil {
+		cloneExtensions(template, cloneFrom)
+	}
+
+	if !noSAN {
+		template.DNSNames = spec.domains
+		template.IPAddresses = parsedIPs
+		if len(spec.unicodeDomains) > 0 {
+			ext, err := unicodeSANExtension(spec.domains, spec.unicodeDomains, parsedIPs)
+			if err != nil {
+				return nil, err
+			}
+			template.ExtraExtensions = append(template.ExtraExtensions, ext)
+		}
+	}
+
+	if bcNonCritical {
+		// crypto/x509 always marks BasicConstraints critical, so encode it
+		// by hand instead.
+		ext, err := nonCriticalBasicConstraints()
+		if err != nil {
+			return nil, err
+		}
+		template.BasicConstraintsValid = false
+		template.ExtraExtensions = append(template.ExtraExtensions, ext)
+	}
+
+	if ocspResponder {
+		if !iss.cert.IsCA || iss.cert.KeyUsage != 0 && iss.cert.KeyUsage&x509.KeyUsageCertSign == 0 {
+			return nil, caErrorf("CA certificate %s can't sign certificates, so it can't delegate OCSP signing", iss.cert.Subject)
+		}
+		template.ExtKeyUsage = []x509.ExtKeyUsage{x509.ExtKeyUsageOCSPSigning}
+		template.ExtraExtensions = append(template.ExtraExtensions, ocspNoCheck())
+	}
+
+	if mustStapleFlag {
+		ext, err := mustStaple()
+		if err != nil {
+			return nil, err
+		}
+		template.ExtraExtensions = append(template.ExtraExtensions, ext)
+	}
+
+	if len(netscapeTypes) > 0 {
+		ext, err := netscapeCertType(netscapeTypes)
+		if err != nil {
+			return nil, err
+		}
+		template.ExtraExtensions = append(template.ExtraExtensions, ext)
+	}
+
+	if msSID != "" {
+		ext, err := msSIDExtension(msSID)
+		if err != nil {
+			return nil, err
+		}
+		template.ExtraExtensions = append(template.ExtraExtensions, ext)
+	}
+
+	// RSA key transport, used before TLS 1.3, needs keyEncipherment.
+	if _, ok := pubKey.(*rsa.PublicKey); ok && !noKeyEncipherment {
+		template.KeyUsage |= x509.KeyUsageKeyEncipherment
+	}
+
+	template.ExtraExtensions = dedupExtensions(template.ExtraExtensions)
+
+	if ctLog != "" {
+		embedSCT(ctLog, template, iss, pubKey)
+	}
+
+	der, err := createCertificate(template, iss.cert, pubKey, certSigner(iss.key))
+	if err != nil {
+		return nil, err
+	}
+	if issuerUniqueID != nil || subjectUniqueID != nil {
+		der, err = addUniqueIDs(der, issuerUniqueID, subjectUniqueID, certSigner(iss.key))
+		if err != nil {
+			return nil, err
+		}
+	}
+	if postVerify {
+		if err := verifyIssued(der, iss.cert); err != nil {
+			// Only remove a key this run created; one loaded by -refresh
+			// stays, like any certificate already there.
+			if generated {
+				os.Remove(keyPath)
+				removeLeafFolder(cnFolder)
+			}
+			return nil, err
+		}
+	}
+	err = writePEM(certPath, &pem.Block{
+		Type:  "CERTIFICATE",
+		Bytes: der,
+	})
+	if err != nil {
+		return nil, err
+	}
+	if auditLogPath != "" {
+		// Record the issuance before anything else can fail.
+		unicodeDomains := spec.unicodeDomains
+		if noSAN {
+			unicodeDomains = nil
+		}
+		err = audit(template, pubKey, unicodeDomains, iss.cert.Raw)
+		if err != nil {
+			return nil, fmt.Errorf("%s was issued, but writing the audit log failed: %s", certPath, err)
+		}
+	}
+	if copyCA {
+		err = writePEM(fmt.Sprintf("%s/ca.pem", cnFolder), &pem.Block{
+			Type:  "CERTIFICATE",
+			Bytes: iss.cert.Raw,
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	if writePKCS7 {
+		err = writeBundle(filepath.Join(cnFolder, "chain.p7b"), der, iss.cert.Raw)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if certbotLayout {
+		chain := encodePEM(&pem.Block{Type: "CERTIFICATE", Bytes: iss.cert.Raw})
+		err = writeFile(fmt.Sprintf("%s/chain.pem", cnFolder), chain)
+		if err != nil {
+			return nil, err
+		}
+		leaf := encodePEM(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+		err = writeFile(fmt.Sprintf("%s/fullchain.pem", cnFolder), append(leaf, chain...))
+		if err != nil {
+			return nil, err
+		}
+	}
+	if writeJWK {
+		err = writeJWKs(cnFolder, key, pubKey)
+		if err != nil {
+			return nil, err
+		}
+	}
+	out := os.Stdout
+	if quiet {
+		out = os.Stderr
+	}
+	if writeSerial {
+		s := serialHex(serial)
+		err = writeFile(fmt.Sprintf("%s/serial.txt", cnFolder), []byte(fmt.Sprintf("%s\n%s\n", serial, s)))
+		if err != nil {
+			return nil, err
+		}
+		fmt.Fprintf(out, "%s %s\n", cnFolder, s)
+	}
+	if key != nil {
+		fmt.Fprintf(out, "key: %s\n", keyPath)
+	}
+	fmt.Fprintf(out, "cert: %s\n", certPath)
+	spec.certPath, spec.keyPath = certPath, keyPath
+	if postHook != "" {
+		err = runPostHook(certPath, keyPath, append(append([]string(nil), spec.domains...), spec.ipAddresses...))
+		if err != nil {
+			return nil, err
+		}
+	}
+	if uploadURL != "" {
+		uploadKey := ""
+		if key != nil {
+			uploadKey = keyPath
+		}
+		err = upload(cn, der, serialHex(serial), uploadKey, iss)
+		if err != nil {
+			return nil, fmt.Errorf("uploading %s failed, the local files are kept: %s", certPath, err)
+		}
+		fmt.Fprintf(out, "uploaded: %s\n", uploadURL)
+	}
+	if len(spec.unicodeDomains) > 0 {
+		// crypto/x509 can't parse the Unicode SANs back.
+		return nil, nil
+	}
+	cert, err := parseCertDER(der)
+	if err != nil {
+		return nil, err
+	}
+	return cert, nil
+}
+
+// verifyIssued checks, for -post-verify, that the certificate der parses
+// and chains to ca, which is trusted as is even when it's an intermediate.
+// It's checked at both ends of its validity period, so a certificate
+// outliving the CA or valid before it fails. -expired and -future
+// certificates may lie outside that of the CA, so only their signature is
+// checked.
+func verifyIssued(der []byte, ca *x509.Certificate) error {
+	cert, err := parseCertDER(der)
+	if err != nil {
+		return verifyErrorf("the new certificate doesn't parse: %s", err)
+	}
+	if expired || future {
+		if err := cert.CheckSignatureFrom(ca); err != nil {
+			return verifyErrorf("the new certificate's signature doesn't verify against %s, so it wasn't written: %s", ca.Subject, err)
+		}
+		return nil
+	}
+	roots := x509.NewCertPool()
+	roots.AddCert(ca)
+	for _, t := range []time.Time{cert.NotBefore, cert.NotAfter} {
+		_, err = cert.Verify(x509.VerifyOptions{
+			Roots:       roots,
+			CurrentTime: t,
+			KeyUsages:   []x509.ExtKeyUsage{x509.ExtKeyUsageAny},
+		})
+		if err != nil {
+			return verifyErrorf("the new certificate doesn't verify against %s at %s, so it wasn't written: %s", ca.Subject, t.Format(time.RFC3339), err)
+		}
+	}
+	return nil
+}
+
+// readSerial returns the serial number stored in the first line of the
+// serial.txt written by -write-serial, or the serial of cert if there is no
+// such file, for -keep-serial.
+func readSerial(path string, cert *x509.Certificate) (*big.Int, error) {
+	contents, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return cert.SerialNumber, nil
+	} else if err != nil {
+		return nil, err
+	}
+	line := strings.TrimSpace(strings.SplitN(string(contents), "\n", 2)[0])
+	serial, ok := new(big.Int).SetString(line, 10)
+	if !ok || serial.Sign() <= 0 {
+		return nil, fmt.Errorf("%s: invalid serial number %q", path, line)
+	}
+	if serial.Cmp(cert.SerialNumber) != 0 {
+		log.Printf("warning: %s holds serial %s, not that of the certificate, %s; keeping the one in %s",
+			path, serialHex(serial), serialHex(cert.SerialNumber), path)
+	}
+	return serial, nil
+}
+
+// serialHex formats a serial number as colon separated hex bytes, as
+// printed by "openssl x509 -text".
+func serialHex(serial *big.Int) string {
+	b := serial.Bytes()
+	if len(b) == 0 {
+		b = []byte{0}
+	}
+	parts := make([]string, len(b))
+	for i, c := range b {
+		parts[i] = fmt.Sprintf("%02x", c)
+	}
+	return strings.Join(parts, ":")
+}
+
+// parseOID parses a dotted decimal object identifier such as "2.5.4.5".
+func parseOID(s string) (asn1.ObjectIdentifier, error) {
+	var oid asn1.ObjectIdentifier
+	for _, part := range strings.Split(s, ".") {
+		n, err := strconv.Atoi(part)
+		if err != nil || n < 0 {
+			return nil, fmt.Errorf("invalid OID %q", s)
+		}
+		oid = append(oid, n)
+	}
+	if len(oid) < 2 {
+		return nil, fmt.Errorf("invalid OID %q", s)
+	}
+	return oid, nil
+}
+
+var oidCommonName = asn1.ObjectIdentifier{2, 5, 4, 3}
+
+// parseAttributes parses "OID=value" pairs into subject attributes.
+func parseAttributes(pairs []string) ([]pkix.AttributeTypeAndValue, error) {
+	var attrs []pkix.AttributeTypeAndValue
+	for _, p := range pairs {
+		i := strings.Index(p, "=")
+		if i < 0 {
+			return nil, usageErrorf("invalid subject attribute %q, expected OID=value", p)
+		}
+		oid, err := parseOID(p[:i])
+		if err != nil {
+			return nil, usageErrorf("invalid subject attribute %q: %s", p, err)
+		}
+		// Go encodes these after the Common Name, so a CN here would give
+		// the subject two, which is ambiguous: clients disagree on which
+		// one counts.
+		if oid.Equal(oidCommonName) {
+			return nil, usageErrorf("invalid subject attribute %q: a subject may have only one Common Name, set it with -common-name", p)
+		}
+		attrs = append(attrs, pkix.AttributeTypeAndValue{Type: oid, Value: p[i+1:]})
+	}
+	return attrs, nil
+}
+
+func split(s string) (results []string) {
+	if len(s) > 0 {
+		return strings.Split(s, ",")
+	}
+	return nil
+}
+
+// readPassword returns the password given directly, read from passwordFile,
+// or taken from the environment variable envVar, in that order. It returns
+// nil if no password was given.
+func readPassword(password, passwordFile, envVar string) ([]byte, error) {
+	if password != "" {
+		return []byte(password), nil
+	}
+	if passwordFile != "" {
+		contents, err := ioutil.ReadFile(passwordFile)
+		if err != nil {
+			return nil, fmt.Errorf("reading password: %s", err)
+		}
+		contents = bytes.TrimRight(contents, "\r\n")
+		if len(contents) == 0 {
+			return nil, usageErrorf("password file %s is empty", passwordFile)
+		}
+		return contents, nil
+	}
+	if v := os.Getenv(envVar); v != "" {
+		return []byte(v), nil
+	}
+	return nil, nil
+}
+
+// readSANs reads newline or comma separated domain names and IP addresses
+// from r.
+func readSANs(r io.Reader) (domains []string, ipAddresses []string, err error) {
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		for _, s := range strings.Split(scanner.Text(), ",") {
+			s = strings.TrimSpace(s)
+			if s == "" {
+				continue
+			}
+			if net.ParseIP(s) != nil {
+				ipAddresses = append(ipAddresses, s)
+			} else {
+				domains = append(domains, s)
+			}
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, nil, fmt.Errorf("reading standard input: %s", err)
+	}
+	return domains, ipAddresses, nil
+}
+
+// dedup returns names without repeated entries, keeping the first
+// occurrence. Names are compared case-insensitively.
+func dedup(names []string) []string {
+	var results []string
+	seen := make(map[string]bool)
+	for _, n := range names {
+		k := strings.ToLower(n)
+		if seen[k] {
+			continue
+		}
+		seen[k] = true
+		results = append(results, n)
+	}
+	return results
+}
+
+// renewSpec updates spec to re-issue the certificate at certPath into the
+// same folder. The certificate's Common Name and SANs are kept, followed by
+// the SANs already in spec and extra. With -reuse-key, the key.pem next to
+// certPath is certified again instead of generating a new key.
+func renewSpec(certPath string, spec *leafSpec, extra []string) error {
+	cert, err := readCert(certPath)
+	if err != nil {
+		return err
+	}
+	if spec.commonName == "" {
+		spec.commonName = cert.Subject.CommonName
+	}
+	spec.folder = filepath.Dir(certPath)
+	mergedDomains := append(cert.DNSNames, spec.domains...)
+	var mergedIPs []string
+	for _, ip := range cert.IPAddresses {
+		mergedIPs = append(mergedIPs, ip.String())
+	}
+	for _, ip := range spec.ipAddresses {
+		p := net.ParseIP(ip)
+		if p == nil {
+			return usageErrorf("invalid IP address %q", ip)
+		}
+		mergedIPs = append(mergedIPs, p.String())
+	}
+	for _, s := range extra {
+		if p := net.ParseIP(s); p != nil {
+			mergedIPs = append(mergedIPs, p.String())
+		} else {
+			mergedDomains = append(mergedDomains, s)
+		}
+	}
+	spec.domains = dedup(mergedDomains)
+	spec.ipAddresses = dedup(mergedIPs)
+
+	if keepSerial {
+		if len(spec.domains) != len(dedup(cert.DNSNames)) || len(spec.ipAddresses) != len(cert.IPAddresses) {
+			return usageErrorf("-keep-serial only re-issues an identical certificate, but the SANs of %s would change", certPath)
+		}
+		spec.serial, err = readSerial(filepath.Join(spec.folder, "serial.txt"), cert)
+		if err != nil {
+			return err
+		}
+	}
+	if reuseKey {
+		keyFile := filepath.Join(spec.folder, leafKeyName())
+		keyContents, err := ioutil.ReadFile(keyFile)
+		if err != nil {
+			return fmt.Errorf("reusing key: %s", err)
+		}
+		key, err := readPrivateKey(keyContents, leafKeyPassword)
+		if err != nil {
+			return fmt.Errorf("reading private key from %s: %s", keyFile, err)
+		}
+		spec.pubKey = publicKey(key)
+	}
+	return nil
+}
+
+// renewAll re-issues every leaf certificate below the current directory that
+// expires within window, and reports how many were renewed.
+func renewAll(ctx context.Context, iss *issuer, window, validity time.Duration) (int, error) {
+	certPaths, err := filepath.Glob(filepath.Join("*", leafCertName()))
+	if err != nil {
+		return 0, err
+	}
+	var renewed, skipped, failed int
+	for _, certPath := range certPaths {
+		cert, err := readCert(certPath)
+		if err != nil && idnBothCert(certPath) {
+			log.Printf("skipping %s: -idn-both certificates can't be read back, re-issue it by hand", certPath)
+			skipped++
+			continue
+		} else if err != nil {
+			log.Println(err)
+			failed++
+			continue
+		}
+		if time.Until(cert.NotAfter) > window {
+			skipped++
+			continue
+		}
+		spec := &leafSpec{validity: validity}
+		err = renewSpec(certPath, spec, nil)
+		if err == nil {
+			_, err = sign(ctx, iss, spec)
+		}
+		if err != nil {
+			log.Printf("renewing %s: %s", certPath, err)
+			failed++
+			continue
+		}
+		renewed++
+	}
+	fmt.Printf("Renewed %d, skipped %d, failed %d\n", renewed, skipped, failed)
+	if failed > 0 {
+		return renewed, fmt.Errorf("failed to renew %d certificates", failed)
+	}
+	return renewed, nil
+}
+
+// bundleTrust writes the CA certificates found in the files matching
+// pattern to filename, each once, as a trust bundle.
+func bundleTrust(pattern, filename string) error {
+	files, err := filepath.Glob(pattern)
+	if err != nil {
+		return usageErrorf("invalid -bundle-cas pattern %q: %s", pattern, err)
+	}
+	var bundle []byte
+	var cas []*x509.Certificate
+	for _, file := range files {
+		if filepath.Clean(file) == filepath.Clean(filename) {
+			continue
+		}
+		contents, err := ioutil.ReadFile(file)
+		if err != nil {
+			return err
+		}
+		certs, err := parseCerts(contents)
+		if err != nil {
+			log.Printf("warning: skipping %s: %s", file, err)
+			continue
+		}
+	next:
+		for _, cert := range certs {
+			if !cert.IsCA {
+				log.Printf("warning: skipping %s in %s, it isn't a CA certificate", cert.Subject, file)
+				continue
+			}
+			for _, ca := range cas {
+				if ca.Equal(cert) {
+					continue next
+				}
+			}
+			cas = append(cas, cert)
+			bundle = append(bundle, encodePEM(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Raw})...)
+		}
+	}
+	if len(cas) == 0 {
+		return usageErrorf("no CA certificates found in files matching %q", pattern)
+	}
+	if err := writeFile(filename, bundle); err != nil {
+		return err
+	}
+	fmt.Printf("Wrote %d CA certificates to %s\n", len(cas), filename)
+	return nil
+}
+
+// keyMatches reports whether the private key in keyPath, decrypted with
+// password if needed, belongs to the certificate in certPath.
+func keyMatches(keyPath, certPath string, password []byte) error {
+	keyContents, err := ioutil.ReadFile(keyPath)
+	if err != nil {
+		return err
+	}
+	key, err := readPrivateKey(keyContents, password)
+	if err != nil {
+		return fmt.Errorf("reading private key from %s: %s", keyPath, err)
+	}
+	certContents, err := ioutil.ReadFile(certPath)
+	if err != nil {
+		return err
+	}
+	cert, err := parseCert(certContents)
+	if err != nil {
+		return fmt.Errorf("reading certificate from %s: %s", certPath, err)
+	}
+	equal, err := publicKeysEqual(publicKey(key), cert.PublicKey)
+	if err != nil {
+		return err
+	} else if !equal {
+		return verifyErrorf("%s doesn't match %s", keyPath, certPath)
+	}
+	fmt.Printf("%s matches %s\n", keyPath, certPath)
+	return nil
+}
+
+// daysLeft formats the whole days until notAfter for -show-expire, marking
+// certificates that have expired or expire within window.
+func daysLeft(notAfter time.Time, window time.Duration) string {
+	left := time.Until(notAfter)
+	days := int(math.Floor(left.Hours() / 24))
+	switch {
+	case left < 0:
+		return fmt.Sprintf("%d EXPIRED", days)
+	case left < window:
+		return fmt.Sprintf("%d SOON", days)
+	}
+	return strconv.Itoa(days)
+}
+
+// prune deletes the folders of leaf certificates below the current directory
+// that expired more than grace ago. Unless yes is set, it lists them and asks
+// for confirmation on in first.
+func prune(grace time.Duration, yes bool, in io.Reader) error {
+	certPaths, err := filepath.Glob(filepath.Join("*", leafCertName()))
+	if err != nil {
+		return err
+	}
+	var folders []string
+	for _, certPath := range certPaths {
+		cert, err := readCert(certPath)
+		if err != nil && idnBothCert(certPath) {
+			log.Printf("skipping %s: -idn-both certificates can't be read back, remove it by hand", certPath)
+			continue
+		} else if err != nil {
+			log.Println(err)
+			continue
+		}
+		// A CA certificate is never pruned, wherever it is.
+		if cert.IsCA || time.Since(cert.NotAfter) <= grace {
+			continue
+		}
+		folder := filepath.Dir(certPath)
+		fmt.Printf("%s expired %s\n", folder, cert.NotAfter.Format("2006-01-02"))
+		folders = append(folders, folder)
+	}
+	if len(folders) == 0 {
+		fmt.Println("Nothing to prune")
+		return nil
+	}
+	if !yes {
+		fmt.Printf("Delete these %d folders? [y/N] ", len(folders))
+		answer, _ := bufio.NewReader(in).ReadString('\n')
+		if a := strings.ToLower(strings.TrimSpace(answer)); a != "y" && a != "yes" {
+			fmt.Println("Nothing deleted")
+			return nil
+		}
+	}
+	for _, folder := range folders {
+		if err := os.RemoveAll(folder); err != nil {
+			return err
+		}
+		fmt.Printf("Removed %s\n", folder)
+	}
+	return nil
 }
 
-func split(s string) (results []string) {
-	if len(s) > 0 {
-		return strings.Split(s, ",")
+// watch runs renewAll every interval until ctx is canceled, running
+// reloadCmd with the shell whenever a certificate was renewed. Canceling
+// ctx is a clean stop, not an error; -timeout only limits each key
+// generation, inside makeKey.
+func watch(ctx context.Context, iss *issuer, window, validity, interval time.Duration, reloadCmd string) error {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		renewed, err := renewAll(ctx, iss, window, validity)
+		if err != nil {
+			log.Print(err)
+		}
+		if renewed > 0 && reloadCmd != "" {
+			cmd := exec.CommandContext(ctx, "/bin/sh", "-c", reloadCmd)
+			cmd.Stdout = os.Stdout
+			cmd.Stderr = os.Stderr
+			if err := cmd.Run(); err != nil {
+				log.Printf("reload command %q: %s", reloadCmd, err)
+			}
+		}
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
+		}
 	}
-	return nil
 }
 
 func main2() error {
-	var caKey = flag.String("ca-key", "microca-key.pem", "Root private key filename, PEM encoded.")
-	var caCert = flag.String("ca-cert", "microca.pem", "Root certificate filename, PEM encoded.")
-	var domains = flag.String("domains", "", "Comma separated domain names to include as Server Alternative Names.")
-	var ipAddresses = flag.String("ip-addresses", "", "Comma separated IP addresses to include as Server Alternative Names.")
+	var caKey = flag.String("ca-key", "microca-key.pem", "Root private key filename, PEM encoded, or env:NAME to read it from environment variable NAME.")
+	var caCert = flag.String("ca-cert", "microca.pem", "Root certificate filename, PEM encoded, or env:NAME to read it from environment variable NAME.")
+	var caNameFlag = flag.String("ca", "", "Use the CA named NAME in the current directory, as given by -ca-pattern; by default NAME-key.pem and NAME.pem. Replaces -ca-key and -ca-cert.")
+	var caPattern = flag.String("ca-pattern", "{name}-key.pem,{name}.pem", "With -ca, the key and certificate file names, separated by a comma, with {name} standing for the CA name.")
+	var caFromSystem = flag.String("ca-from-system", "", "Experimental: use the CA certificate in the system trust store whose subject contains this text, with its key from -ca-key. Same as -ca-cert system:TEXT. Only PEM stores on Unix systems are searched.")
+	var domains = flag.String("domains", "", "Comma separated domain names to include as Server Alternative Names. A numeric range such as node[01-50].example.com expands to one name per number.")
+	var ipAddresses = flag.String("ip-addresses", "", "Comma separated IP addresses to include as Server Alternative Names. resolve:HOST adds the current IPv4 and IPv6 addresses of HOST, looked up in DNS.")
+	var allowUnderscores = flag.Bool("allow-underscores", false, "Allow underscores in domain names.")
+	var domainPattern = flag.String("domain-regex", "", "Regular expression domain names must match, overriding the default "+defaultDomainPattern)
+	var readStdin = flag.Bool("stdin", false, "Read newline or comma separated domain names and IP addresses from standard input, after those given by -domains and -ip-addresses. \"-domains -\" reads only from standard input.")
+	var expandEach = flag.Bool("expand-each", false, "Issue one certificate per name expanded from a range such as node[01-50].example.com in the domain names, instead of one certificate with all of them.")
+	var subjectFlag = flag.String("subject", "", "Full leaf subject as an RFC 4514 distinguished name, such as \"CN=web,OU=Ops,O=Example\\, Inc.,C=US\". Replaces -common-name, -subject-serial and -subject-extra.")
+	var exactSNI = flag.String("exact-sni", "", "Issue a certificate for exactly this one fully qualified hostname, refusing wildcards, IP addresses and any other names.")
+	var commonName = flag.String("common-name", "", "Common Name of the leaf certificate (default the first domain name or IP address).")
+	var renew = flag.String("renew", "", "Re-issue the certificate at this path with the same Server Alternative Names, replacing its key and certificate.")
+	var archivePath = flag.String("archive", "", "Write the files of issued certificates into this .tar.gz, .tgz or .zip archive, laid out as they would be on disk, instead of leaf folders. With -copy-ca it includes the CA certificate.")
+	var serveAddr = flag.String("serve", "", "After issuing, serve HTTPS with the new certificate on this address, such as :8443, until interrupted.")
+	var selfSigned = flag.Bool("self-signed", false, "Issue a single self-signed leaf certificate, its own issuer, without reading or creating a CA. For throwaway servers whose certificate is trusted some other way.")
+	var explainFlag = flag.Bool("explain", false, "Describe the certificates the other flags would issue, then exit without issuing.")
+	var checkKeyMatch = flag.Bool("check-key-match", false, "Check whether the private key and certificate files given as arguments, in that order, belong together, then exit. Exits with 5 if they don't.")
+	flag.StringVar(&uploadURL, "upload-url", "", "After issuing, POST the certificate, its key and the CA certificate as JSON to this https URL, such as a Vault KV version 2 secret. The local files are kept.")
+	flag.BoolVar(&uploadInsecure, "upload-insecure", false, "Allow a plain http -upload-url, sending the private key and token unencrypted.")
+	flag.StringVar(&uploadToken, "upload-token", "", "Bearer token for -upload-url. Prefer $MICROCA_UPLOAD_TOKEN, which doesn't expose it to other users.")
+	var netscapeFlag = flag.String("netscape-cert-type", "", "Deprecated, for very old devices only: comma separated Netscape certificate types (client, server, email, objsign, sslCA, emailCA, objCA) to set in leaves.")
+	var bundleCAs = flag.String("bundle-cas", "", "Write every CA certificate in the files matching this glob, such as \"*.pem\", to trust.pem for distribution to clients, then exit. Duplicates are dropped and other certificates skipped.")
+	var verifyHostname = flag.String("verify-hostname", "", "Check whether this host name or IP address matches the certificate file given as argument, following TLS wildcard rules, then exit. Exits with 5 if it doesn't.")
+	var compare = flag.Bool("compare", false, "Compare the two certificate files given as arguments field by field, then exit.")
+	var listKeys = flag.Bool("list-key-types", false, "List the supported key types and curves, then exit.")
+	var benchFlag = flag.Bool("bench", false, "Measure how many leaf certificates per second can be issued for each key type, signing with a throwaway CA of the type chosen by the key flags, then exit. Nothing is written.")
+	var benchDuration = flag.Duration("bench-duration", 2*time.Second, "With -bench, how long to issue certificates of each key type.")
+	var benchCount = flag.Int("bench-count", 0, "With -bench, issue this many certificates of each key type instead of running for -bench-duration.")
+	var caCSR = flag.String("ca-csr", "", "Generate the CA key and write a request for an intermediate CA certificate to this file, for signing by an external root. Save the signed certificate as -ca-cert to issue from it.")
+	var printCA = flag.Bool("print-ca", false, "Write the CA certificate to standard output, creating the CA if needed.")
+	var csrOnly = flag.Bool("csr-only", false, "Generate a key and a certificate signing request (csr.pem) instead of a certificate, for signing by an offline CA.")
+	var csrPath = flag.String("csr", "", "Sign the certificate signing request at this path instead of generating a new key.")
+	var renewAllFlag = flag.Bool("renew-all", false, "Re-issue every leaf certificate in the current directory expiring within -expiring-within.")
+	var pruneFlag = flag.Bool("prune", false, "Delete the folders of leaf certificates in the current directory that have expired, after asking for confirmation, then exit. CA files are never removed.")
+	var pruneGrace = flag.String("prune-grace", "", "With -prune, only delete certificates expired for longer than this, such as 30d.")
+	var yes = flag.Bool("yes", false, "With -prune, delete without asking for confirmation.")
+	var expiringWithin = flag.String("expiring-within", "30d", "With -renew-all or -watch, renew certificates expiring within this period. With -show-expire, mark them.")
+	flag.StringVar(expiringWithin, "renew-threshold", "30d", "Same as -expiring-within.")
+	var watchFlag = flag.Bool("watch", false, "Stay running, doing -renew-all every -watch-interval.")
+	var watchInterval = flag.Duration("watch-interval", time.Hour, "How often -watch checks for expiring certificates.")
+	var reloadCmd = flag.String("reload-cmd", "", "With -watch, a shell command to run after certificates are renewed, such as \"systemctl reload nginx\".")
+	var addSAN = flag.String("add-san", "", "Comma separated domain names and IP addresses to add when re-issuing with -renew.")
+	var caDNSFlag = flag.String("ca-dns", "", "Comma separated domain names to include as SANs in a newly created root certificate.")
+	var caURIFlag = flag.String("ca-uri", "", "Comma separated URIs, such as spiffe://example.org, to include as SANs in a newly created root certificate.")
+	var caIssuersFlag = flag.String("ca-issuers-url", "", "Comma separated http or https URLs where clients can fetch the CA certificate, set as AIA CA Issuers in leaf certificates.")
+	var keyOnly = flag.String("key-only", "", "Only generate a leaf key, of the type chosen by the key flags, in this file and exit. Use it later with -reuse-key or -refresh.")
+	var keyPassFile = flag.String("key-password-file", "", "File containing a password encrypting leaf private keys, also read from $MICROCA_KEY_PASSWORD.")
+	var caKeyPass = flag.String("ca-key-password", "", "Password encrypting the CA private key. Prefer -ca-key-password-file or $MICROCA_CA_KEY_PASSWORD, which don't expose it to other users.")
+	var caKeyPassFile = flag.String("ca-key-password-file", "", "File containing the password encrypting the CA private key.")
+	var seedFlag = flag.String("deterministic-seed", "", "INSECURE, for test fixtures only: hex encoded seed making keys and serial numbers reproducible.")
+	var clonePath = flag.String("clone-from", "", "Copy the extensions of this PEM certificate, such as key usages, policies, AIA and CRL distribution points, into leaf certificates. Other flags take precedence.")
+	var sigAlg = flag.String("signature-algorithm", "", "Algorithm the CA signs leaf certificates with, such as SHA384WithRSA, SHA256WithRSAPSS or ECDSAWithSHA384 (default chosen from the CA key).")
+	var validityFlag = flag.String("validity", "", "Leaf certificate validity, such as 90d or 2160h (default 2 years and 30 days).")
+	var certSpecs stringList
+	flag.Var(&certSpecs, "cert", "Issue a certificate described as domains=a.com,b.com;ip=10.0.0.1;validity=90d, optionally with its own key type: key=ecdsa|rsa|ed25519, curve=P384, bits=2048. May be repeated to issue several certificates; other flags apply to all of them.")
+	flag.Var(&keyRecipients, "key-recipient", "Encrypt leaf keys to this age or SSH public key, writing key.pem.age, using the age command. May be repeated for several recipients.")
+	var extraAttrs stringList
+	flag.Var(&extraAttrs, "subject-extra", "Additional leaf subject attribute as OID=value, for example 2.5.4.97=VATDE-123. May be repeated.")
+	var issuerUID = flag.String("issuer-unique-id", "", "For interop testing only: hex encoded issuerUniqueID to set in leaf certificates. Almost never needed.")
+	var subjectUID = flag.String("subject-unique-id", "", "For interop testing only: hex encoded subjectUniqueID to set in leaf certificates. Almost never needed.")
+	flag.StringVar(&auditLogPath, "audit-log", "", "Append a JSON line describing each issued certificate, with the time, operator ($USER), serial, subject, SANs, key type, validity and CA fingerprint, to this file.")
+	flag.StringVar(&postHook, "post-hook", "", "Shell command to run after each certificate is issued, with MICROCA_CERT, MICROCA_KEY and MICROCA_SANS set.")
+	flag.StringVar(&ctLog, "ct-log", "", "Base URL of a Certificate Transparency log, for testing: submit each leaf's precertificate and embed the returned SCT. Log errors only cause a warning.")
+	flag.StringVar(&msSID, "ms-sid", "", "Active Directory security identifier, such as S-1-5-21-..., to include in leaf certificates for strong certificate mapping.")
+	flag.StringVar(&subjectSerial, "subject-serial", "", "Serial number attribute to include in the leaf subject (not the certificate serial).")
+	flag.BoolVar(&ackCompat, "ack-compat", false, "Don't print client compatibility notices when creating an Ed25519 or P-521 CA.")
+	flag.BoolVar(&allowEmptyCAName, "allow-empty-ca-name", false, "Allow creating a CA whose subject is empty. Some validators reject such roots.")
+	flag.BoolVar(&browserCompat, "browser-compat", false, "Follow the CA/Browser Forum baseline for leaves: at most 397 days validity (the default with this flag), 64 bits of serial entropy, the serverAuth extended key usage and Subject Alternative Names.")
+	flag.BoolVar(&bcNonCritical, "bc-noncritical", false, "Mark the BasicConstraints extension of leaf certificates non-critical, for legacy validators.")
+	flag.BoolVar(&certbotLayout, "certbot-layout", false, "Name leaf files like certbot: privkey.pem and cert.pem, plus chain.pem (the CA) and fullchain.pem (the leaf followed by the CA).")
+	flag.BoolVar(&copyCA, "copy-ca", false, "Also write a copy of the CA certificate to ca.pem in each leaf folder.")
+	flag.BoolVar(&deterministicECDSA, "deterministic-ecdsa", false, "Sign certificates with deterministic (RFC 6979), low-S ECDSA signatures, so identical certificates get identical signatures. Needs microca built with Go 1.24 or later.")
 	flag.BoolVar(&ed25519Key, "ed25519", false, "Generate ED25519 keys")
+	flag.BoolVar(&expired, "expired", false, "For testing only: issue a leaf certificate that expired yesterday.")
+	flag.BoolVar(&folderHash, "folder-hash", false, "Append a short hash of the Common Name and SANs to each leaf folder name, so distinct certificates never share a folder.")
+	flag.BoolVar(&future, "future", false, "For testing only: issue a leaf certificate that becomes valid tomorrow.")
+	flag.BoolVar(&grpcProfile, "grpc", false, "Issue gRPC server certificates: serverAuth and clientAuth, named only by Subject Alternative Names with an empty Common Name.")
+	flag.BoolVar(&idnBoth, "idn-both", false, "NON-STANDARD interop hack: include internationalized domain names both as punycode (xn--) and as Unicode SANs, for clients that only match one form. By default only the punycode form is included, as RFC 5280 requires.")
+	flag.BoolVar(&ipv4Only, "ipv4-only", false, "Leave out IPv6 addresses, including only the IPv4 ones given.")
+	flag.BoolVar(&ipv6Only, "ipv6-only", false, "Leave out IPv4 addresses, including only the IPv6 ones given.")
+	flag.BoolVar(&jsonErrors, "json-errors", false, "On failure, print a JSON object with the exit code, message, and file or SAN involved to standard error.")
+	flag.BoolVar(&mustStapleFlag, "must-staple", false, "Add the OCSP must-staple TLS Feature extension to leaves. Clients will then require the server to staple an OCSP response.")
+	flag.BoolVar(&noAutoCA, "no-auto-ca", false, "Fail if the CA key and certificate don't exist, instead of creating a new CA.")
+	flag.BoolVar(&noDir, "no-dir", false, "Write leaf files directly into -output-dir instead of a folder named after the Common Name. Only one certificate can be issued per run.")
+	flag.BoolVar(&noKeyEncipherment, "no-key-encipherment", false, "Omit keyEncipherment from RSA leaf certificates, which TLS 1.3 doesn't need.")
+	flag.BoolVar(&noSAN, "no-san", false, "Omit the Subject Alternative Name extension, naming the leaf only by its Common Name. Modern clients reject such certificates.")
+	flag.BoolVar(&noSHA1CA, "no-sha1-ca", false, "Refuse to use a CA certificate signed with SHA-1.")
+	flag.BoolVar(&ocspResponder, "ocsp-responder", false, "Issue a delegated OCSP responder certificate, with the OCSPSigning extended key usage and the ocsp-nocheck extension. Use -common-name to name it.")
+	flag.BoolVar(&pemStrict, "pem-strict", false, "Guarantee PEM output without headers and with a single trailing newline.")
+	flag.BoolVar(&postVerify, "post-verify", false, "Check that each new certificate parses and chains to its CA before writing it, failing with exit code 5 and removing only the files this run created if it doesn't.")
+	flag.BoolVar(&quiet, "quiet", false, "Print the paths of issued keys and certificates to standard error instead of standard output.")
+	flag.BoolVar(&refresh, "refresh", false, "Issue a new certificate for the key already in the leaf's folder, leaving the key untouched and replacing any existing certificate.")
+	flag.BoolVar(&reproducible, "reproducible", false, "INSECURE, for test fixtures only: make output byte-identical across runs with the same flags, using -deterministic-seed (or a fixed seed), -deterministic-ecdsa and $SOURCE_DATE_EPOCH as the issue time.")
+	flag.BoolVar(&reissueCACert, "reissue-ca-cert", false, "If the CA key exists but its certificate doesn't, create a new root certificate for the existing key.")
+	flag.BoolVar(&keepSerial, "keep-serial", false, "With -renew or -renew-all and -reuse-key, keep the serial number from the leaf's serial.txt, or its certificate, instead of choosing a new one. Only for identical re-issues; the SANs can't change.")
+	flag.BoolVar(&reuseKey, "reuse-key", false, "When renewing, certify the existing key.pem again instead of generating a new key.")
 	flag.BoolVar(&rsaKey, "rsa", false, "Generate RSA keys")
 	flag.BoolVar(&showExp, "show-expire", false, "Show the expiration date for each certificate.")
+	flag.BoolVar(&writeJWK, "jwk", false, "Also write the leaf key as JSON Web Keys: key.jwk (private) and pub.jwk (public).")
+	flag.BoolVar(&writePKCS7, "pkcs7", false, "Also write the leaf and CA certificates, without keys, as a PKCS #7 bundle named chain.p7b.")
+	flag.BoolVar(&writeSerial, "write-serial", false, "Write each leaf's serial number, in decimal and colon separated hex, to serial.txt, and print the hex form.")
+	flag.BoolVar(&strict, "strict", false, "Reject IP addresses given as domain names instead of including them as IP addresses.")
+	flag.BoolVar(&strictHostnames, "validate-san-hostnames", false, "Reject domain names that aren't valid hostnames: empty labels, labels over 63 characters, names over 253 characters or misplaced wildcards.")
+	flag.BoolVar(&verbose, "verbose", false, "Print details about the CA being used.")
+	flag.StringVar(&outputDir, "output-dir", "", "Directory in which leaf folders are created (default the current directory).")
+	flag.StringVar(&keyFilename, "key-filename", "", "File name of leaf private keys (default key.pem).")
+	flag.StringVar(&certFilename, "cert-filename", "", "File name of leaf certificates (default cert.pem).")
+	flag.DurationVar(&keygenTimeout, "timeout", 0, "Give up if generating a key takes longer than this, such as 30s (default no limit). Each key gets the full time.")
+	flag.DurationVar(&timeGranularity, "time-granularity", time.Minute, "Round the start of certificate validity periods down to a multiple of this, such as 1s or 1h, keeping their length; 0 keeps the exact time of issue.")
+	flag.DurationVar(&backdate, "backdate", 0, "Start leaf validity this long before now, such as 1h, to allow for clock skew. The validity period is measured from the backdated start.")
 	flag.IntVar(&rsaBits, "rsa-bits", 4096, "RSA key size in bits.")
-	flag.StringVar(&ecdsaCurve, "ecdsa-curve", "P256", "ECDSA curve used when generating keys (P224, P256 (default), P384, P521).")
+	flag.IntVar(&rsaExponent, "rsa-exponent", 65537, "RSA public exponent, for interop testing. Values other than 65537 are unusual and some software rejects them.")
+	flag.IntVar(&maxSANs, "max-sans", 0, "Refuse to issue a certificate with more Subject Alternative Names than this (default no limit).")
+	flag.IntVar(&intermediatePathLen, "intermediate-path-len", -1, "The pathLenConstraint limiting how many CAs may be below the CA: requested for the intermediate with -ca-csr, set on a new root, and checked against an existing CA certificate before issuing from it. 0 lets the CA sign only leaves; -1 requests no limit from -ca-csr and leaves a new root at 0.")
+	flag.IntVar(&requireExplicitPolicy, "ca-require-explicit-policy", -1, "Add a policyConstraints extension to a new CA requiring an explicit policy after this many further certificates; -1 leaves it out.")
+	flag.IntVar(&inhibitPolicyMapping, "ca-inhibit-policy-mapping", -1, "Add a policyConstraints extension to a new CA inhibiting policy mapping after this many further certificates; -1 leaves it out.")
+	flag.IntVar(&inhibitAnyPolicy, "ca-inhibit-any-policy", -1, "Add an inhibitAnyPolicy extension to a new CA, making anyPolicy stop matching after this many further certificates; -1 leaves it out.")
+	flag.IntVar(&warnSANs, "warn-sans", 100, "Warn when a certificate has more Subject Alternative Names than this; 0 disables the warning.")
+	flag.StringVar(&serialMode, "serial-mode", "random", "How serial numbers are made: random, or timestamp for serials that sort in issue order, with 64 random bits instead of 63 or more.")
+	flag.StringVar(&ecdsaCurve, "ecdsa-curve", "P256", "ECDSA curve used when generating keys (P224, P256 (default), P384, P521, or secp256k1 for leaf keys only).")
 	flag.StringVar(&caName, "ca-name", "microca root", "Common Name used in root certificate.")
 	flag.Usage = func() {
 		fmt.Fprintf(os.Stderr, "Usage of %s:\n", os.Args[0])
@@ -376,20 +2641,74 @@ for generating certificates for RPC systems or microservices.
 
 On first run, microca will generate a keypair and a root certificate in the
 current directory, and will reuse that same keypair and root certificate
-unless they are deleted.
+unless they are deleted. Pass -no-auto-ca to fail instead of creating a CA.
 
 On each run, microca will generate a new keypair and sign an end-entity (leaf)
 certificate for that keypair. The certificate will contain a list of DNS names
 and/or IP addresses from the command line flags. The key and certificate are
 placed in a new directory whose name is chosen as the first domain name from
-the certificate, or the first IP address if no domain names are present. It
-will not overwrite existing keys or certificates.
+the certificate, or the first IP address if no domain names are present,
+with "*" replaced by "_" (see -folder-hash). It will not overwrite existing
+keys or certificates, except when re-issuing a certificate with -renew.
+
+Exit codes:
+  0  success
+  1  unclassified error
+  2  invalid flags, domain names or IP addresses
+  3  CA missing, unreadable, or its key and certificate don't match
+  4  refusing to overwrite an existing file
+  5  verification failed
 
 `)
 		flag.PrintDefaults()
 	}
 	flag.Parse()
 
+	if *listKeys {
+		return listKeyTypes(os.Stdout)
+	}
+	if *benchFlag {
+		if *benchCount < 0 || *benchDuration <= 0 {
+			return usageErrorf("-bench-count must not be negative and -bench-duration must be positive")
+		}
+		return bench(os.Stdout, *benchDuration, *benchCount)
+	}
+
+	if *bundleCAs != "" {
+		return bundleTrust(*bundleCAs, filepath.Join(outputDir, "trust.pem"))
+	}
+	if *verifyHostname != "" {
+		if flag.NArg() != 1 {
+			return usageErrorf("-verify-hostname needs one certificate file")
+		}
+		cert, err := readCert(flag.Arg(0))
+		if err != nil {
+			return err
+		}
+		if err := cert.VerifyHostname(*verifyHostname); err != nil {
+			return verifyErrorf("%s: %s", flag.Arg(0), err)
+		}
+		fmt.Printf("%s matches %s\n", *verifyHostname, flag.Arg(0))
+		return nil
+	}
+	if *compare {
+		if flag.NArg() != 2 {
+			return usageErrorf("-compare needs two certificate files")
+		}
+		a, err := readCert(flag.Arg(0))
+		if err != nil {
+			return err
+		}
+		b, err := readCert(flag.Arg(1))
+		if err != nil {
+			return err
+		}
+		fmt.Printf("--- %s\n+++ %s\n", flag.Arg(0), flag.Arg(1))
+		n := compareCerts(os.Stdout, a, b)
+		fmt.Printf("%d fields differ\n", n)
+		return nil
+	}
+
 	if showExp {
 		afp, err := filepath.Abs(".")
 		if err != nil {
@@ -398,8 +2717,13 @@ will not overwrite existing keys or certificates.
 		caW := tabwriter.NewWriter(os.Stdout, 0, 0, 1, ' ', 0)
 		w := tabwriter.NewWriter(os.Stdout, 0, 0, 1, ' ', 0)
 
-		fmt.Fprintf(caW, "CA Certificate\tType\tExpiration\n")
-		fmt.Fprintf(w, "Leaf Certificate\tType\tExpiration\n")
+		window, err := parseValidity(*expiringWithin)
+		if err != nil {
+			return err
+		}
+
+		fmt.Fprintf(caW, "CA Certificate\tType\tExpiration\tDays Left\n")
+		fmt.Fprintf(w, "Leaf Certificate\tType\tExpiration\tDays Left\n")
 
 		topCerts, err := filepath.Glob("./*.pem")
 		if err != nil {
@@ -415,11 +2739,12 @@ will not overwrite existing keys or certificates.
 				return err
 			}
 
-			fmt.Fprintf(caW, "%s (%s)\t%s\t%s\n",
+			fmt.Fprintf(caW, "%s (%s)\t%s\t%s\t%s\n",
 				cert.Subject,
 				tc,
 				cert.PublicKeyAlgorithm,
 				cert.NotAfter,
+				daysLeft(cert.NotAfter, window),
 			)
 		}
 		fmt.Fprintf(caW, "\t\n")
@@ -436,14 +2761,18 @@ will not overwrite existing keys or certificates.
 				certFile := path.Join(info.Name(), "cert.pem")
 				if _, err := os.Stat(certFile); err == nil {
 					cert, err := readCert(certFile)
-					if err != nil {
+					if err != nil && idnBothCert(certFile) {
+						log.Printf("skipping %s: -idn-both certificates can't be read back", certFile)
+						return nil
+					} else if err != nil {
 						return err
 					}
 
-					fmt.Fprintf(w, "%s\t%s\t%s\n",
+					fmt.Fprintf(w, "%s\t%s\t%s\t%s\n",
 						strings.Join(cert.DNSNames, ", "),
 						cert.PublicKeyAlgorithm,
 						cert.NotAfter,
+						daysLeft(cert.NotAfter, window),
 					)
 				}
 			}
@@ -455,38 +2784,498 @@ will not overwrite existing keys or certificates.
 		return nil
 	}
 
-	if *domains == "" && *ipAddresses == "" {
-		flag.Usage()
-		os.Exit(1)
+	if *pruneFlag {
+		var grace time.Duration
+		if *pruneGrace != "" {
+			var err error
+			grace, err = parseValidity(*pruneGrace)
+			if err != nil {
+				return err
+			}
+		}
+		return prune(grace, *yes, os.Stdin)
+	}
+
+	ctx := context.Background()
+
+	var err error
+	subjectExtra, err = parseAttributes(extraAttrs)
+	if err != nil {
+		return err
+	}
+	if msSID != "" && !sidRe.MatchString(msSID) {
+		return usageErrorf("invalid -ms-sid %q, expected a security identifier such as S-1-5-21-1004336348-1177238915-682003330-512", msSID)
+	}
+	issuerUniqueID, err = parseUniqueID(*issuerUID)
+	if err != nil {
+		return err
+	}
+	subjectUniqueID, err = parseUniqueID(*subjectUID)
+	if err != nil {
+		return err
+	}
+	if reproducible {
+		if *seedFlag == "" {
+			*seedFlag = hex.EncodeToString([]byte("microca reproducible"))
+		}
+		deterministicECDSA = true
+		epoch := os.Getenv("SOURCE_DATE_EPOCH")
+		if epoch == "" {
+			return usageErrorf("-reproducible needs $SOURCE_DATE_EPOCH, the issue time in seconds since 1970")
+		}
+		secs, err := strconv.ParseInt(epoch, 10, 64)
+		if err != nil {
+			return usageErrorf("invalid $SOURCE_DATE_EPOCH %q", epoch)
+		}
+		fixedTime = time.Unix(secs, 0).UTC()
+	}
+	if deterministicECDSA && !deterministicECDSASupported {
+		return usageErrorf("-deterministic-ecdsa and -reproducible need microca built with Go 1.24 or later")
+	}
+	if *seedFlag != "" {
+		seed, err := hex.DecodeString(*seedFlag)
+		if err != nil || len(seed) == 0 {
+			return usageErrorf("invalid -deterministic-seed, expected hex")
+		}
+		log.Println("WARNING: -deterministic-seed makes every key predictable to anyone who knows the seed. " +
+			"Use it only for test fixtures, never for real certificates.")
+		random = seededReader(seed)
+		seeded = true
+	}
+	caKeyPassword, err = readPassword(*caKeyPass, *caKeyPassFile, "MICROCA_CA_KEY_PASSWORD")
+	if err != nil {
+		return err
+	}
+	leafKeyPassword, err = readPassword("", *keyPassFile, "MICROCA_KEY_PASSWORD")
+	if err != nil {
+		return err
+	}
+
+	if *checkKeyMatch {
+		if flag.NArg() != 2 {
+			return usageErrorf("-check-key-match needs a key file and a certificate file")
+		}
+		password := leafKeyPassword
+		if password == nil {
+			// The key may be a CA key.
+			password = caKeyPassword
+		}
+		return keyMatches(flag.Arg(0), flag.Arg(1), password)
+	}
+
+	if *keyOnly != "" {
+		if _, err := makeKey(ctx, *keyOnly, leafKeyPassword, nil, flagKeyType()); err != nil {
+			return err
+		}
+		fmt.Printf("key: %s\n", *keyOnly)
+		return nil
+	}
+	if *caNameFlag != "" {
+		if *caKey != "microca-key.pem" || *caCert != "microca.pem" {
+			return usageErrorf("-ca can't be combined with -ca-key or -ca-cert")
+		}
+		*caKey, *caCert, err = caPaths(*caNameFlag, *caPattern)
+		if err != nil {
+			return err
+		}
+	}
+	if *caFromSystem != "" {
+		if *caCert != "microca.pem" {
+			return usageErrorf("-ca-from-system can't be combined with -ca-cert")
+		}
+		*caCert = systemPrefix + *caFromSystem
+	}
+	if uploadURL != "" {
+		u, err := url.Parse(uploadURL)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return usageErrorf("invalid -upload-url %q, expected an https URL", uploadURL)
+		} else if u.Scheme == "http" && !uploadInsecure {
+			return usageErrorf("-upload-url %q would send the private key and token unencrypted; use https, or pass -upload-insecure if that's really wanted", uploadURL)
+		}
+		if uploadToken == "" {
+			uploadToken = os.Getenv("MICROCA_UPLOAD_TOKEN")
+		}
+	}
+	netscapeTypes = split(*netscapeFlag)
+	if len(netscapeTypes) > 0 {
+		if _, err := netscapeCertType(netscapeTypes); err != nil {
+			return err
+		}
+	}
+	caDNS = split(*caDNSFlag)
+	for _, s := range split(*caURIFlag) {
+		u, err := url.Parse(s)
+		if err != nil || !u.IsAbs() {
+			return usageErrorf("invalid -ca-uri %q, expected an absolute URI", s)
+		}
+		caURIs = append(caURIs, u)
+	}
+	for _, s := range split(*caIssuersFlag) {
+		u, err := url.Parse(s)
+		if err != nil || !u.IsAbs() || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return usageErrorf("invalid -ca-issuers-url %q, expected an absolute http or https URL", s)
+		}
+		caIssuers = append(caIssuers, s)
+	}
+
+	for _, n := range []int{requireExplicitPolicy, inhibitPolicyMapping, inhibitAnyPolicy} {
+		if n < -1 {
+			return usageErrorf("invalid policy constraint %d, expected a number of certificates or -1", n)
+		}
+	}
+	if intermediatePathLen < -1 {
+		return usageErrorf("invalid -intermediate-path-len %d", intermediatePathLen)
+	}
+	if *caCSR != "" {
+		return makeCACSR(ctx, *caKey, *caCSR)
+	}
+
+	if *printCA {
+		issuer, err := getIssuer(ctx, *caKey, *caCert)
+		if err != nil {
+			return err
+		}
+		_, err = os.Stdout.Write(encodePEM(&pem.Block{
+			Type:  "CERTIFICATE",
+			Bytes: issuer.cert.Raw,
+		}))
+		return err
+	}
+
+	if *clonePath != "" {
+		cloneFrom, err = readCert(*clonePath)
+		if err != nil {
+			return err
+		}
+	}
+	if *sigAlg != "" {
+		signatureAlgorithm, err = parseSignatureAlgorithm(*sigAlg)
+		if err != nil {
+			return err
+		}
+	}
+	if rsaExponent < 3 || rsaExponent%2 == 0 || rsaExponent > 1<<31-1 {
+		return usageErrorf("invalid -rsa-exponent %d, it must be odd, at least 3 and less than 2^31", rsaExponent)
+	} else if rsaExponent != 65537 && rsaKey {
+		log.Printf("warning: RSA public exponent %d is unusual; some clients reject exponents other than 65537", rsaExponent)
+	}
+	if backdate < 0 {
+		return usageErrorf("-backdate must not be negative")
+	}
+	if serialMode != "random" && serialMode != "timestamp" {
+		return usageErrorf("invalid -serial-mode %q, expected random or timestamp", serialMode)
+	}
+	if timeGranularity < 0 {
+		return usageErrorf("-time-granularity must not be negative")
+	}
+	if expired && future {
+		return usageErrorf("-expired and -future are mutually exclusive")
+	}
+	if expired || future {
+		log.Println("warning: issuing a certificate with a deliberately invalid validity period, for testing only")
+	}
+
+	var validity time.Duration
+	if *validityFlag != "" {
+		validity, err = parseValidity(*validityFlag)
+		if err != nil {
+			return err
+		}
+	}
+	if browserCompat {
+		if noSAN {
+			return usageErrorf("-browser-compat requires Subject Alternative Names and can't be combined with -no-san")
+		}
+		if ocspResponder || *clonePath != "" {
+			// Both can replace the serverAuth extended key usage.
+			return usageErrorf("-browser-compat requires the serverAuth extended key usage and can't be combined with -ocsp-responder or -clone-from")
+		}
+		if validity == 0 {
+			validity = maxBrowserValidity
+		} else if validity > maxBrowserValidity {
+			return usageErrorf("-browser-compat limits validity to 397 days, not %g", validity.Hours()/24)
+		}
+	}
+
+	if *addSAN != "" && *renew == "" {
+		return usageErrorf("-add-san requires -renew")
+	}
+	if keepSerial {
+		if (*renew == "" && !*renewAllFlag && !*watchFlag) || !reuseKey {
+			return usageErrorf("-keep-serial requires -reuse-key and -renew, -renew-all or -watch")
+		}
+		log.Println("warning: -keep-serial reuses serial numbers; a serial must identify one certificate, so only re-issue certificates identical but for their validity")
+	}
+
+	if *reloadCmd != "" && !*watchFlag {
+		return usageErrorf("-reload-cmd requires -watch")
+	}
+	if *watchFlag && *watchInterval <= 0 {
+		return usageErrorf("-watch-interval must be positive")
+	}
+	if *renewAllFlag || *watchFlag {
+		window, err := parseValidity(*expiringWithin)
+		if err != nil {
+			return err
+		}
+		issuer, err := getIssuer(ctx, *caKey, *caCert)
+		if err != nil {
+			return err
+		}
+		overwrite = true
+		if *watchFlag {
+			// Stop between renewals on SIGINT or SIGTERM.
+			ctx, cancel := context.WithCancel(ctx)
+			defer cancel()
+			sigs := make(chan os.Signal, 1)
+			signal.Notify(sigs, os.Interrupt, syscall.SIGTERM)
+			defer signal.Stop(sigs)
+			go func() {
+				select {
+				case <-sigs:
+					cancel()
+				case <-ctx.Done():
+				}
+			}()
+			return watch(ctx, issuer, window, validity, *watchInterval, *reloadCmd)
+		}
+		_, err = renewAll(ctx, issuer, window, validity)
+		return err
+	}
+	if grpcProfile && noSAN {
+		return usageErrorf("-grpc certificates are named only by their Subject Alternative Names and can't be combined with -no-san")
+	}
+	if noSAN {
+		log.Println("warning: issuing without Subject Alternative Names; modern browsers and most TLS clients will reject the certificate")
+	}
+
+	if *exactSNI != "" && *domains == "" && len(certSpecs) == 0 {
+		*domains = *exactSNI
+	}
+	var specs []*leafSpec
+	if len(certSpecs) > 0 {
+		if *domains != "" || *ipAddresses != "" || *readStdin || *commonName != "" || *renew != "" || *csrPath != "" {
+			return usageErrorf("-cert can't be combined with -domains, -ip-addresses, -stdin, -common-name, -renew or -csr")
+		}
+		for _, cs := range certSpecs {
+			spec, err := parseLeafSpec(cs)
+			if err != nil {
+				return err
+			}
+			if spec.validity == 0 {
+				spec.validity = validity
+			}
+			specs = append(specs, spec)
+		}
+	} else {
+		spec := &leafSpec{
+			commonName:  *commonName,
+			domains:     split(*domains),
+			ipAddresses: split(*ipAddresses),
+			validity:    validity,
+		}
+		if *domains == "-" || *readStdin {
+			stdinDomains, stdinIPs, err := readSANs(os.Stdin)
+			if err != nil {
+				return err
+			}
+			if *domains == "-" {
+				spec.domains = nil
+			}
+			spec.domains = dedup(append(spec.domains, stdinDomains...))
+			spec.ipAddresses = dedup(append(spec.ipAddresses, stdinIPs...))
+		}
+		if *renew != "" {
+			err = renewSpec(*renew, spec, split(*addSAN))
+			if err != nil {
+				return err
+			}
+			overwrite = true
+		}
+		if *csrPath != "" {
+			if *csrOnly || *renew != "" {
+				return usageErrorf("-csr can't be combined with -csr-only or -renew")
+			}
+			csr, err := readCSR(*csrPath)
+			if err != nil {
+				return err
+			}
+			spec.domains = dedup(append(csr.DNSNames, spec.domains...))
+			var csrIPs []string
+			for _, ip := range csr.IPAddresses {
+				csrIPs = append(csrIPs, ip.String())
+			}
+			spec.ipAddresses = dedup(append(csrIPs, spec.ipAddresses...))
+			spec.pubKey = csr.PublicKey
+		}
+		if len(spec.domains) == 0 && len(spec.ipAddresses) == 0 && !((noSAN || ocspResponder) && spec.commonName != "") {
+			flag.Usage()
+			os.Exit(exitUsage)
+		}
+		specs = append(specs, spec)
+	}
+	specs, err = expandSpecs(specs, *expandEach)
+	if err != nil {
+		return err
+	}
+	for _, spec := range specs {
+		spec.ipAddresses, err = resolveIPs(ctx, spec.ipAddresses)
+		if err != nil {
+			return err
+		}
+	}
+	if *subjectFlag != "" {
+		seq, err := parseDN(*subjectFlag)
+		if err != nil {
+			return err
+		}
+		if *commonName != "" || subjectSerial != "" || len(extraAttrs) > 0 {
+			log.Println("warning: -subject replaces -common-name, -subject-serial and -subject-extra, which are ignored")
+		}
+		var name pkix.Name
+		name.FillFromRDNSequence(&seq)
+		if name.CommonName != "" && len(specs) > 1 {
+			return usageErrorf("-subject with a Common Name would give every certificate the same name; issue one certificate per run")
+		} else if name.CommonName != "" && grpcProfile {
+			return usageErrorf("-grpc certificates have no Common Name, but -subject sets one")
+		}
+		for _, spec := range specs {
+			// The folder is named after the subject's Common Name, or the
+			// first SAN without one.
+			spec.commonName = name.CommonName
+		}
+		subjectDN, err = asn1.Marshal(seq)
+		if err != nil {
+			return err
+		}
+	}
+
+	if refresh {
+		if *csrPath != "" || *csrOnly {
+			return usageErrorf("-refresh can't be combined with -csr or -csr-only")
+		}
+		overwrite = true
+	}
+	if *serveAddr != "" && (len(specs) > 1 || *csrPath != "" || *csrOnly) {
+		return usageErrorf("-serve needs a single certificate with its key, so it can't be combined with -csr, -csr-only or several -cert")
+	}
+	if *archivePath != "" && (*serveAddr != "" || postHook != "" || uploadURL != "" || *csrOnly) {
+		return usageErrorf("-archive can't be combined with -serve, -post-hook, -upload-url or -csr-only, which need the files on disk")
+	}
+	if len(keyRecipients) > 0 && (refresh || reuseKey || writeJWK || *serveAddr != "") {
+		return usageErrorf("-key-recipient can't be combined with -refresh, -reuse-key, -jwk or -serve, which need the key unencrypted")
+	}
+	if idnBoth {
+		if *serveAddr != "" || ctLog != "" || *selfSigned || postVerify {
+			return usageErrorf("-idn-both certificates can't be read back by microca, so it can't be combined with -serve, -ct-log, -self-signed or -post-verify")
+		}
+		log.Println("WARNING: -idn-both adds Unicode dNSName SANs, which violate RFC 5280. Many TLS libraries, Go's included, reject such certificates, and microca itself can't -renew them")
+	}
+	if ipv4Only && ipv6Only {
+		return usageErrorf("-ipv4-only and -ipv6-only are mutually exclusive")
+	}
+	if noDir && len(specs) > 1 {
+		return usageErrorf("-no-dir writes every certificate to the same files; issue one certificate per run")
+	}
+	if browserCompat {
+		for _, spec := range specs {
+			if spec.validity > maxBrowserValidity {
+				return usageErrorf("-browser-compat limits validity to 397 days, not %g", spec.validity.Hours()/24)
+			}
+		}
+	}
+	if grpcProfile {
+		for _, spec := range specs {
+			if len(spec.domains) == 0 && len(spec.ipAddresses) == 0 {
+				return usageErrorf("-grpc needs at least one domain name or IP address")
+			}
+		}
 	}
 
 	if len(flag.Args()) > 0 {
-		fmt.Printf("Extra arguments: %s (maybe there are spaces in your domain list?)\n", flag.Args())
-		os.Exit(1)
+		return usageErrorf("extra arguments: %s (maybe there are spaces in your domain list?)", flag.Args())
+	}
+
+	pattern := defaultDomainPattern
+	if *domainPattern != "" {
+		pattern = *domainPattern
+	} else if *allowUnderscores {
+		pattern = underscoreDomainPattern
+	}
+	domainRe, err := regexp.Compile(pattern)
+	if err != nil {
+		return usageErrorf("invalid -domain-regex: %s", err)
+	}
+	for _, spec := range specs {
+		if err := validateSANs(spec, domainRe); err != nil {
+			return err
+		}
+	}
+	if *exactSNI != "" {
+		if err := checkExactSNI(*exactSNI, specs); err != nil {
+			return err
+		}
+	}
+
+	if *selfSigned {
+		if len(specs) > 1 || *csrPath != "" || *csrOnly || *renew != "" || refresh || *explainFlag || *serveAddr != "" || *archivePath != "" || uploadURL != "" {
+			return usageErrorf("-self-signed issues one new certificate and key, so it can't be combined with several -cert, -csr, -csr-only, -renew, -refresh, -explain, -serve, -archive or -upload-url")
+		}
+		if copyCA || writePKCS7 || certbotLayout || ocspResponder || ctLog != "" || caIssuers != nil || cloneFrom != nil {
+			return usageErrorf("-self-signed uses no CA, so it can't be combined with -copy-ca, -pkcs7, -certbot-layout, -ocsp-responder, -ct-log, -ca-issuers-url or -clone-from")
+		}
+		return selfSign(ctx, specs[0])
 	}
 
-	domainSlice := split(*domains)
-	domainRe := regexp.MustCompile("^[A-Za-z0-9.*-]+$")
-	for _, d := range domainSlice {
-		if !domainRe.MatchString(d) {
-			fmt.Printf("Invalid domain name %q\n", d)
-			os.Exit(1)
+	if *explainFlag {
+		// Only load a CA that's complete; explaining mustn't create one.
+		var iss *issuer
+		_, keyErr := readSource(*caKey)
+		_, certErr := readSource(*caCert)
+		if !(os.IsNotExist(keyErr) && os.IsNotExist(certErr)) && !(keyErr == nil && os.IsNotExist(certErr) && reissueCACert) {
+			iss, err = getIssuer(ctx, *caKey, *caCert)
+			if err != nil {
+				return err
+			}
 		}
+		return explain(os.Stdout, specs, iss)
 	}
 
-	ipSlice := split(*ipAddresses)
-	for _, ip := range ipSlice {
-		if net.ParseIP(ip) == nil {
-			fmt.Printf("Invalid IP address %q\n", ip)
-			os.Exit(1)
+	if *csrOnly {
+		for _, spec := range specs {
+			if err := makeCSR(ctx, spec); err != nil {
+				return err
+			}
 		}
+		return nil
 	}
 
-	issuer, err := getIssuer(*caKey, *caCert)
+	issuer, err := getIssuer(ctx, *caKey, *caCert)
 	if err != nil {
 		return err
 	}
 
-	_, err = sign(issuer, domainSlice, ipSlice)
-	return err
+	if *archivePath != "" {
+		archive, err = createArchive(*archivePath)
+		if err != nil {
+			return err
+		}
+	}
+	for _, spec := range specs {
+		if _, err := sign(ctx, issuer, spec); err != nil {
+			if archive != nil {
+				archive.abort()
+			}
+			return err
+		}
+	}
+	if archive != nil {
+		if err := archive.close(); err != nil {
+			return err
+		}
+	}
+	if *serveAddr != "" {
+		return serve(*serveAddr, specs[0], issuer)
+	}
+	return nil
 }
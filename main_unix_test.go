@@ -0,0 +1,41 @@
+//go:build darwin || dragonfly || freebsd || linux || netbsd || openbsd
+// +build darwin dragonfly freebsd linux netbsd openbsd
+
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+)
+
+// Files and folders get exactly the requested modes, whatever the umask.
+func TestModesIgnoreUmask(t *testing.T) {
+	defer func(old string) { outputDir = old }(outputDir)
+	for _, umask := range []int{0, 0022, 0077, 0277, 0777} {
+		dir := t.TempDir()
+		outputDir = dir
+		old := syscall.Umask(umask)
+		err := writeFile(filepath.Join(dir, "key.pem"), []byte("test"))
+		if err == nil {
+			_, _, err = leafFolder(&leafSpec{domains: []string{"umask.example"}})
+		}
+		syscall.Umask(old)
+		if err != nil {
+			t.Fatalf("umask %04o: %s", umask, err)
+		}
+		for name, want := range map[string]os.FileMode{
+			"key.pem":       0600,
+			"umask.example": 0700 | os.ModeDir,
+		} {
+			info, err := os.Stat(filepath.Join(dir, name))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if info.Mode() != want {
+				t.Errorf("umask %04o: %s has mode %s, want %s", umask, name, info.Mode(), want)
+			}
+		}
+	}
+}
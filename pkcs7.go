@@ -0,0 +1,97 @@
+package main
+
+import (
+	"bytes"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"fmt"
+	"sort"
+)
+
+// Certificate-only PKCS #7 bundles (RFC 2315, section 9.1): a SignedData
+// with no content and no signers, often called a .p7b file. This fixed
+// structure is all microca writes, so it's encoded with encoding/asn1
+// rather than a PKCS #7 library; TestPKCS7OpenSSL checks that OpenSSL
+// reads it back.
+
+var (
+	oidPKCS7Data       = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 7, 1}
+	oidPKCS7SignedData = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 7, 2}
+)
+
+type pkcs7ContentInfo struct {
+	ContentType asn1.ObjectIdentifier
+	Content     asn1.RawValue `asn1:"optional"` // [0] EXPLICIT
+}
+
+type pkcs7SignedData struct {
+	Version          int
+	DigestAlgorithms []pkix.AlgorithmIdentifier `asn1:"set"`
+	ContentInfo      pkcs7ContentInfo
+	Certificates     asn1.RawValue   `asn1:"optional,tag:0"`
+	SignerInfos      []asn1.RawValue `asn1:"set"`
+}
+
+// marshalPKCS7 returns a DER encoded PKCS #7 bundle of the given DER
+// certificates. certificates is a SET OF, so DER puts them in the order of
+// their encodings rather than the order given.
+func marshalPKCS7(certs ...[]byte) ([]byte, error) {
+	sorted := append([][]byte(nil), certs...)
+	sort.Slice(sorted, func(i, j int) bool {
+		return bytes.Compare(sorted[i], sorted[j]) < 0
+	})
+	sd, err := asn1.Marshal(pkcs7SignedData{
+		Version:     1,
+		ContentInfo: pkcs7ContentInfo{ContentType: oidPKCS7Data},
+		Certificates: asn1.RawValue{
+			Class:      asn1.ClassContextSpecific,
+			Tag:        0,
+			IsCompound: true,
+			Bytes:      bytes.Join(sorted, nil),
+		},
+	})
+	if err != nil {
+		return nil, err
+	}
+	return asn1.Marshal(pkcs7ContentInfo{
+		ContentType: oidPKCS7SignedData,
+		Content: asn1.RawValue{
+			Class:      asn1.ClassContextSpecific,
+			Tag:        0,
+			IsCompound: true,
+			Bytes:      sd,
+		},
+	})
+}
+
+// parsePKCS7 returns the certificates in a DER encoded PKCS #7 bundle.
+func parsePKCS7(der []byte) ([]*x509.Certificate, error) {
+	var ci pkcs7ContentInfo
+	if rest, err := asn1.Unmarshal(der, &ci); err != nil {
+		return nil, fmt.Errorf("parsing PKCS #7: %s", err)
+	} else if len(rest) > 0 {
+		return nil, fmt.Errorf("parsing PKCS #7: trailing data")
+	}
+	if !ci.ContentType.Equal(oidPKCS7SignedData) {
+		return nil, fmt.Errorf("PKCS #7 content type is %s, not signedData", ci.ContentType)
+	}
+	var sd pkcs7SignedData
+	if _, err := asn1.Unmarshal(ci.Content.Bytes, &sd); err != nil {
+		return nil, fmt.Errorf("parsing PKCS #7 signedData: %s", err)
+	}
+	var certs []*x509.Certificate
+	for rest := sd.Certificates.Bytes; len(rest) > 0; {
+		var raw asn1.RawValue
+		var err error
+		if rest, err = asn1.Unmarshal(rest, &raw); err != nil {
+			return nil, fmt.Errorf("parsing PKCS #7 certificates: %s", err)
+		}
+		cert, err := parseCertDER(raw.FullBytes)
+		if err != nil {
+			return nil, err
+		}
+		certs = append(certs, cert)
+	}
+	return certs, nil
+}
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"bytes"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/pem"
+	"math/big"
+	"os/exec"
+	"path/filepath"
+	"testing"
+)
+
+func TestMarshalPKCS7(t *testing.T) {
+	rootKey, leafKey := testKey(t), testKey(t)
+	root := testCA(t, "root", -1, rootKey, nil, nil)
+	leaf := testCert(t, &x509.Certificate{Subject: pkix.Name{CommonName: "leaf"}}, root, &leafKey.PublicKey, rootKey)
+
+	for _, order := range [][][]byte{{leaf.Raw, root.Raw}, {root.Raw, leaf.Raw}} {
+		der, err := marshalPKCS7(order...)
+		if err != nil {
+			t.Fatal(err)
+		}
+		certs, err := parsePKCS7(der)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(certs) != 2 {
+			t.Fatalf("parsed %d certificates, want 2", len(certs))
+		}
+		// DER orders the SET OF by the encodings, whatever the input order.
+		if bytes.Compare(certs[0].Raw, certs[1].Raw) > 0 {
+			t.Errorf("certificates aren't in DER SET OF order")
+		}
+		for _, want := range order {
+			if !bytes.Equal(certs[0].Raw, want) && !bytes.Equal(certs[1].Raw, want) {
+				t.Errorf("certificate missing from the bundle")
+			}
+		}
+
+		var ci pkcs7ContentInfo
+		if _, err := asn1.Unmarshal(der, &ci); err != nil {
+			t.Fatal(err)
+		}
+		var sd pkcs7SignedData
+		if _, err := asn1.Unmarshal(ci.Content.Bytes, &sd); err != nil {
+			t.Fatal(err)
+		}
+		// Re-encoding the parsed structure gives the same bytes only if
+		// the original was DER.
+		again, err := asn1.Marshal(sd)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(again, ci.Content.Bytes) {
+			t.Errorf("signedData doesn't re-encode to the same bytes")
+		}
+	}
+}
+
+func TestWriteBundle(t *testing.T) {
+	rootKey, leafKey := testKey(t), testKey(t)
+	root := testCA(t, "root", -1, rootKey, nil, nil)
+	leaf := testCert(t, &x509.Certificate{Subject: pkix.Name{CommonName: "leaf"}}, root, &leafKey.PublicKey, rootKey)
+	filename := filepath.Join(t.TempDir(), "chain.p7b")
+	if err := writeBundle(filename, leaf.Raw, root.Raw); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// OpenSSL reads back every certificate of a bundle, the secp256k1 ones
+// included.
+func TestPKCS7OpenSSL(t *testing.T) {
+	if _, err := exec.LookPath("openssl"); err != nil {
+		t.Skip("openssl not found")
+	}
+	rootKey, leafKey := testKey(t), testKey(t)
+	root := testCA(t, "root", -1, rootKey, nil, nil)
+	leaf := testCert(t, &x509.Certificate{Subject: pkix.Name{CommonName: "leaf"}}, root, &leafKey.PublicKey, rootKey)
+	want := [][]byte{leaf.Raw, root.Raw}
+	if secp256k1Curve != nil {
+		k1Key, err := generateKey(keyType{algorithm: "ecdsa", curve: "secp256k1"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		k1, err := createCertificate(&x509.Certificate{SerialNumber: big.NewInt(3), Subject: pkix.Name{CommonName: "k1"}}, root, publicKey(k1Key), rootKey)
+		if err != nil {
+			t.Fatal(err)
+		}
+		want = append(want, k1)
+	}
+	filename := filepath.Join(t.TempDir(), "chain.p7b")
+	if err := writeBundle(filename, want...); err != nil {
+		t.Fatal(err)
+	}
+	out, err := exec.Command("openssl", "pkcs7", "-inform", "DER", "-in", filename, "-print_certs").Output()
+	if err != nil {
+		t.Fatalf("openssl pkcs7: %s", err)
+	}
+	var got [][]byte
+	for {
+		var block *pem.Block
+		block, out = pem.Decode(out)
+		if block == nil {
+			break
+		}
+		got = append(got, block.Bytes)
+	}
+	if len(got) != len(want) {
+		t.Fatalf("openssl read %d certificates, want %d", len(got), len(want))
+	}
+	for _, w := range want {
+		found := false
+		for _, g := range got {
+			found = found || bytes.Equal(g, w)
+		}
+		if !found {
+			t.Errorf("certificate missing from openssl's output")
+		}
+	}
+}
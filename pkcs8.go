@@ -0,0 +1,200 @@
+package main
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/binary"
+	"fmt"
+	"hash"
+	"io"
+)
+
+// Encrypted PKCS #8 private keys (RFC 5958) using PBES2 (RFC 8018) with
+// PBKDF2 and AES-CBC, the scheme written by "openssl pkcs8 -topk8 -v2".
+
+var (
+	oidPBES2          = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 5, 13}
+	oidPBKDF2         = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 5, 12}
+	oidHMACWithSHA1   = asn1.ObjectIdentifier{1, 2, 840, 113549, 2, 7}
+	oidHMACWithSHA256 = asn1.ObjectIdentifier{1, 2, 840, 113549, 2, 9}
+	oidAES128CBC      = asn1.ObjectIdentifier{2, 16, 840, 1, 101, 3, 4, 1, 2}
+	oidAES192CBC      = asn1.ObjectIdentifier{2, 16, 840, 1, 101, 3, 4, 1, 22}
+	oidAES256CBC      = asn1.ObjectIdentifier{2, 16, 840, 1, 101, 3, 4, 1, 42}
+)
+
+// pbkdf2Iterations is the PBKDF2 iteration count used for new keys.
+const pbkdf2Iterations = 600000
+
+type encryptedPrivateKeyInfo struct {
+	Algorithm     pkix.AlgorithmIdentifier
+	EncryptedData []byte
+}
+
+type pbes2Params struct {
+	KeyDerivationFunc pkix.AlgorithmIdentifier
+	EncryptionScheme  pkix.AlgorithmIdentifier
+}
+
+type pbkdf2Params struct {
+	Salt           []byte
+	IterationCount int
+	KeyLength      int                      `asn1:"optional"`
+	PRF            pkix.AlgorithmIdentifier `asn1:"optional"`
+}
+
+// pbkdf2 derives a key from password as described in RFC 8018, section 5.2.
+func pbkdf2(password, salt []byte, iterations, keyLen int, h func() hash.Hash) []byte {
+	prf := hmac.New(h, password)
+	var dk []byte
+	for block := uint32(1); len(dk) < keyLen; block++ {
+		prf.Reset()
+		prf.Write(salt)
+		var counter [4]byte
+		binary.BigEndian.PutUint32(counter[:], block)
+		prf.Write(counter[:])
+		u := prf.Sum(nil)
+		t := append([]byte(nil), u...)
+		for i := 1; i < iterations; i++ {
+			prf.Reset()
+			prf.Write(u)
+			u = prf.Sum(u[:0])
+			for j := range t {
+				t[j] ^= u[j]
+			}
+		}
+		dk = append(dk, t...)
+	}
+	return dk[:keyLen]
+}
+
+// encryptPKCS8 encrypts a DER encoded PKCS #8 private key with password,
+// using PBKDF2-HMAC-SHA256 and AES-256-CBC.
+func encryptPKCS8(der, password []byte) ([]byte, error) {
+	salt := make([]byte, 16)
+	iv := make([]byte, aes.BlockSize)
+	if _, err := io.ReadFull(random, salt); err != nil {
+		return nil, err
+	}
+	if _, err := io.ReadFull(random, iv); err != nil {
+		return nil, err
+	}
+	key := pbkdf2(password, salt, pbkdf2Iterations, 32, sha256.New)
+
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	padding := aes.BlockSize - len(der)%aes.BlockSize
+	data := append(append([]byte(nil), der...), bytes.Repeat([]byte{byte(padding)}, padding)...)
+	cipher.NewCBCEncrypter(block, iv).CryptBlocks(data, data)
+
+	kdfParams, err := asn1.Marshal(pbkdf2Params{
+		Salt:           salt,
+		IterationCount: pbkdf2Iterations,
+		PRF: pkix.AlgorithmIdentifier{
+			Algorithm:  oidHMACWithSHA256,
+			Parameters: asn1.NullRawValue,
+		},
+	})
+	if err != nil {
+		return nil, err
+	}
+	ivParams, err := asn1.Marshal(iv)
+	if err != nil {
+		return nil, err
+	}
+	params, err := asn1.Marshal(pbes2Params{
+		KeyDerivationFunc: pkix.AlgorithmIdentifier{
+			Algorithm:  oidPBKDF2,
+			Parameters: asn1.RawValue{FullBytes: kdfParams},
+		},
+		EncryptionScheme: pkix.AlgorithmIdentifier{
+			Algorithm:  oidAES256CBC,
+			Parameters: asn1.RawValue{FullBytes: ivParams},
+		},
+	})
+	if err != nil {
+		return nil, err
+	}
+	return asn1.Marshal(encryptedPrivateKeyInfo{
+		Algorithm: pkix.AlgorithmIdentifier{
+			Algorithm:  oidPBES2,
+			Parameters: asn1.RawValue{FullBytes: params},
+		},
+		EncryptedData: data,
+	})
+}
+
+// decryptPKCS8 decrypts an encrypted PKCS #8 private key, returning the DER
+// encoded PKCS #8 key. Only PBES2 with PBKDF2 and AES-CBC is supported.
+func decryptPKCS8(der, password []byte) ([]byte, error) {
+	var info encryptedPrivateKeyInfo
+	if _, err := asn1.Unmarshal(der, &info); err != nil {
+		return nil, fmt.Errorf("parsing encrypted key: %s", err)
+	}
+	if !info.Algorithm.Algorithm.Equal(oidPBES2) {
+		return nil, fmt.Errorf("unsupported key encryption %s, only PBES2 is supported", info.Algorithm.Algorithm)
+	}
+	var params pbes2Params
+	if _, err := asn1.Unmarshal(info.Algorithm.Parameters.FullBytes, &params); err != nil {
+		return nil, fmt.Errorf("parsing PBES2 parameters: %s", err)
+	}
+	if !params.KeyDerivationFunc.Algorithm.Equal(oidPBKDF2) {
+		return nil, fmt.Errorf("unsupported key derivation %s, only PBKDF2 is supported", params.KeyDerivationFunc.Algorithm)
+	}
+	var kdf pbkdf2Params
+	if _, err := asn1.Unmarshal(params.KeyDerivationFunc.Parameters.FullBytes, &kdf); err != nil {
+		return nil, fmt.Errorf("parsing PBKDF2 parameters: %s", err)
+	}
+	h := sha1.New
+	if len(kdf.PRF.Algorithm) > 0 {
+		switch {
+		case kdf.PRF.Algorithm.Equal(oidHMACWithSHA1):
+		case kdf.PRF.Algorithm.Equal(oidHMACWithSHA256):
+			h = sha256.New
+		default:
+			return nil, fmt.Errorf("unsupported PBKDF2 PRF %s", kdf.PRF.Algorithm)
+		}
+	}
+	var keyLen int
+	switch scheme := params.EncryptionScheme.Algorithm; {
+	case scheme.Equal(oidAES128CBC):
+		keyLen = 16
+	case scheme.Equal(oidAES192CBC):
+		keyLen = 24
+	case scheme.Equal(oidAES256CBC):
+		keyLen = 32
+	default:
+		return nil, fmt.Errorf("unsupported key cipher %s, only AES-CBC is supported", scheme)
+	}
+	var iv []byte
+	if _, err := asn1.Unmarshal(params.EncryptionScheme.Parameters.FullBytes, &iv); err != nil || len(iv) != aes.BlockSize {
+		return nil, fmt.Errorf("invalid AES-CBC IV")
+	}
+	if kdf.IterationCount < 1 {
+		return nil, fmt.Errorf("invalid PBKDF2 iteration count %d", kdf.IterationCount)
+	}
+
+	key := pbkdf2(password, kdf.Salt, kdf.IterationCount, keyLen, h)
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	data := info.EncryptedData
+	if len(data) == 0 || len(data)%aes.BlockSize != 0 {
+		return nil, fmt.Errorf("invalid encrypted key length")
+	}
+	data = append([]byte(nil), data...)
+	cipher.NewCBCDecrypter(block, iv).CryptBlocks(data, data)
+	padding := int(data[len(data)-1])
+	if padding == 0 || padding > aes.BlockSize || !bytes.Equal(data[len(data)-padding:], bytes.Repeat([]byte{byte(padding)}, padding)) {
+		return nil, fmt.Errorf("incorrect password")
+	}
+	return data[:len(data)-padding], nil
+}
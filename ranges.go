@@ -0,0 +1,100 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// maxRangeNames caps the number of domain names a single run may expand
+// numeric ranges into.
+const maxRangeNames = 1000
+
+// expandRange expands a domain name with a numeric range such as
+// node[01-50].example.com into node01.example.com ... node50.example.com.
+// A lower bound with a leading zero pads every number to its width. Names
+// without a range are returned as they are.
+func expandRange(name string) ([]string, error) {
+	open := strings.Index(name, "[")
+	if open < 0 {
+		return []string{name}, nil
+	}
+	end := strings.Index(name[open:], "]")
+	if end < 0 {
+		return nil, usageErrorf("invalid range in %q: missing ]", name)
+	}
+	end += open
+	prefix, body, suffix := name[:open], name[open+1:end], name[end+1:]
+	if strings.ContainsAny(suffix, "[]") {
+		return nil, usageErrorf("invalid range in %q: only one range is allowed per name", name)
+	}
+	bounds := strings.Split(body, "-")
+	if len(bounds) != 2 {
+		return nil, usageErrorf("invalid range in %q, expected [first-last] such as [01-50]", name)
+	}
+	first, err1 := strconv.Atoi(bounds[0])
+	last, err2 := strconv.Atoi(bounds[1])
+	if err1 != nil || err2 != nil || first < 0 || bounds[0][0] == '+' || bounds[1][0] == '+' {
+		return nil, usageErrorf("invalid range in %q: bounds must be non-negative numbers", name)
+	} else if first > last {
+		return nil, usageErrorf("invalid range in %q: %d is greater than %d", name, first, last)
+	} else if last-first >= maxRangeNames {
+		// last-first+1 could overflow.
+		return nil, usageErrorf("range in %q expands to %d names, more than the limit of %d", name, uint64(last-first)+1, maxRangeNames)
+	}
+	width := 0
+	if len(bounds[0]) > 1 && bounds[0][0] == '0' {
+		width = len(bounds[0])
+	}
+	var names []string
+	// Counting up to last-first, as n <= last is always true when last is
+	// the largest int.
+	for i := 0; i <= last-first; i++ {
+		names = append(names, fmt.Sprintf("%s%0*d%s", prefix, width, first+i, suffix))
+	}
+	return names, nil
+}
+
+// expandSpecs expands numeric ranges in the domain names of specs. Each
+// spec keeps all its expanded names, or with each set becomes one spec per
+// name expanded from its range, sharing its other names and settings.
+func expandSpecs(specs []*leafSpec, each bool) ([]*leafSpec, error) {
+	var out []*leafSpec
+	total := 0
+	for _, spec := range specs {
+		var plain, expanded []string
+		ranges := 0
+		for _, d := range spec.domains {
+			names, err := expandRange(d)
+			if err != nil {
+				return nil, &sanError{d, err}
+			}
+			if len(names) == 1 && names[0] == d {
+				plain = append(plain, d)
+				continue
+			}
+			ranges++
+			total += len(names)
+			expanded = append(expanded, names...)
+		}
+		if total > maxRangeNames {
+			return nil, usageErrorf("ranges expand to more than the limit of %d names", maxRangeNames)
+		}
+		if !each || ranges == 0 {
+			spec.domains = dedup(append(expanded, plain...))
+			out = append(out, spec)
+			continue
+		}
+		if ranges > 1 {
+			return nil, usageErrorf("-expand-each needs a single range per certificate, not %d", ranges)
+		} else if spec.commonName != "" || spec.folder != "" {
+			return nil, usageErrorf("-expand-each names each certificate after its own domain, so it can't be combined with a Common Name or folder")
+		}
+		for _, name := range expanded {
+			s := *spec
+			s.domains = dedup(append([]string{name}, plain...))
+			out = append(out, &s)
+		}
+	}
+	return out, nil
+}
@@ -0,0 +1,47 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestExpandRange(t *testing.T) {
+	tests := []struct {
+		name string
+		want []string // nil if the name is refused
+	}{
+		{"www.example.com", []string{"www.example.com"}},
+		{"node[1-3].example.com", []string{"node1.example.com", "node2.example.com", "node3.example.com"}},
+		{"node[08-10].example.com", []string{"node08.example.com", "node09.example.com", "node10.example.com"}},
+		{"node[5-5].example.com", []string{"node5.example.com"}},
+		{"node[1-1000].example.com", nil}, // checked by length below
+		{"node[0-1000].example.com", nil},
+		{"node[3-1].example.com", nil},
+		{"node[-1-3].example.com", nil},
+		{"node[+1-3].example.com", nil},
+		{"node[1-3.example.com", nil},
+		{"node[1-3][1-3].example.com", nil},
+		{"node[a-z].example.com", nil},
+		{"a[0-9223372036854775807].example.com", nil},
+		{"a[9223372036854775806-9223372036854775807].example.com", []string{"a9223372036854775806.example.com", "a9223372036854775807.example.com"}},
+		{"a[0-9223372036854775808].example.com", nil},
+	}
+	for _, tt := range tests {
+		got, err := expandRange(tt.name)
+		if tt.name == "node[1-1000].example.com" {
+			if err != nil || len(got) != maxRangeNames {
+				t.Errorf("%s: got %d names, %v", tt.name, len(got), err)
+			}
+			continue
+		}
+		if tt.want == nil {
+			if err == nil {
+				t.Errorf("%s: expanded to %d names, want an error", tt.name, len(got))
+			}
+			continue
+		}
+		if err != nil || !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: got %q, %v, want %q", tt.name, got, err, tt.want)
+		}
+	}
+}
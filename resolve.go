@@ -0,0 +1,52 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strings"
+	"time"
+)
+
+// resolvePrefix marks an -ip-addresses entry naming a host whose addresses
+// are looked up in DNS, such as resolve:db.example.com.
+const resolvePrefix = "resolve:"
+
+// maxResolvedIPs caps the number of addresses a single resolve: entry may
+// add, so a name with many records can't flood the certificate.
+const maxResolvedIPs = 16
+
+// resolveTimeout bounds each DNS lookup.
+const resolveTimeout = 10 * time.Second
+
+// resolveIPs looks up the A and AAAA records of the hosts named by
+// resolve: entries in ipAddresses and returns ipAddresses with each such
+// entry replaced by the addresses found, in the order the resolver gave
+// them. Other entries are kept as they are.
+func resolveIPs(ctx context.Context, ipAddresses []string) ([]string, error) {
+	var out []string
+	for _, s := range ipAddresses {
+		if !strings.HasPrefix(s, resolvePrefix) {
+			out = append(out, s)
+			continue
+		}
+		host := strings.TrimSuffix(s[len(resolvePrefix):], ".")
+		if host == "" || net.ParseIP(host) != nil {
+			return nil, &sanError{s, usageErrorf("invalid %q, expected resolve:hostname", s)}
+		}
+		lookupCtx, cancel := context.WithTimeout(ctx, resolveTimeout)
+		addrs, err := net.DefaultResolver.LookupIPAddr(lookupCtx, host)
+		cancel()
+		if err != nil {
+			return nil, &sanError{s, fmt.Errorf("resolving %s for -ip-addresses: %s", host, err)}
+		} else if len(addrs) == 0 {
+			return nil, &sanError{s, fmt.Errorf("resolving %s for -ip-addresses: no addresses found", host)}
+		} else if len(addrs) > maxResolvedIPs {
+			return nil, &sanError{s, usageErrorf("%s resolves to %d addresses, more than the limit of %d", host, len(addrs), maxResolvedIPs)}
+		}
+		for _, a := range addrs {
+			out = append(out, a.IP.String())
+		}
+	}
+	return dedup(out), nil
+}
@@ -0,0 +1,63 @@
+//go:build go1.24
+// +build go1.24
+
+package main
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"encoding/asn1"
+	"fmt"
+	"io"
+	"math/big"
+)
+
+// Deterministic ECDSA signatures (RFC 6979) for -deterministic-ecdsa. Since
+// Go 1.24, crypto/ecdsa derives the nonce from the key and the message
+// instead of reading it from rand when rand is nil, so signing the same
+// certificate twice gives the same bytes. s is then normalized to the
+// lower half of the group order. Verifiers can't tell these signatures
+// from random ones, so any ECDSA client accepts them; only tools expecting
+// a fresh signature each time would notice.
+
+// deterministicECDSASupported reports whether -deterministic-ecdsa can be
+// used, which needs Go 1.24 or later.
+const deterministicECDSASupported = true
+
+// deterministicECDSASigner signs with an ECDSA key using RFC 6979 nonces
+// and low-S signatures.
+type deterministicECDSASigner struct {
+	key *ecdsa.PrivateKey
+}
+
+func (s deterministicECDSASigner) Public() crypto.PublicKey {
+	return &s.key.PublicKey
+}
+
+// Sign ignores rand and signs digest, which must be the output of
+// opts.HashFunc().
+func (s deterministicECDSASigner) Sign(_ io.Reader, digest []byte, opts crypto.SignerOpts) ([]byte, error) {
+	der, err := s.key.Sign(nil, digest, opts)
+	if err != nil {
+		return nil, fmt.Errorf("deterministic ECDSA: %s", err)
+	}
+	var sig struct{ R, S *big.Int }
+	if _, err := asn1.Unmarshal(der, &sig); err != nil {
+		return nil, err
+	}
+	n := s.key.Curve.Params().N
+	if sig.S.Cmp(new(big.Int).Rsh(n, 1)) <= 0 {
+		return der, nil
+	}
+	sig.S.Sub(n, sig.S)
+	return asn1.Marshal(sig)
+}
+
+// certSigner returns the signer to use for a CA key, substituting a
+// deterministic one for ECDSA keys under -deterministic-ecdsa.
+func certSigner(key interface{}) interface{} {
+	if k, ok := key.(*ecdsa.PrivateKey); ok && deterministicECDSA {
+		return deterministicECDSASigner{k}
+	}
+	return key
+}
@@ -0,0 +1,13 @@
+//go:build !go1.24
+// +build !go1.24
+
+package main
+
+// deterministicECDSASupported is false before Go 1.24, whose crypto/ecdsa
+// can't sign deterministically.
+const deterministicECDSASupported = false
+
+// certSigner returns key; -deterministic-ecdsa is refused at startup.
+func certSigner(key interface{}) interface{} {
+	return key
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	_ "crypto/sha256"
+	_ "crypto/sha512"
+	"encoding/asn1"
+	"math/big"
+	"testing"
+)
+
+func hexInt(t *testing.T, s string) *big.Int {
+	t.Helper()
+	i, ok := new(big.Int).SetString(s, 16)
+	if !ok {
+		t.Fatalf("invalid hex %q", s)
+	}
+	return i
+}
+
+// The known-answer tests of RFC 6979, appendix A.2.5 (P-256) and A.2.6
+// (P-384).
+func TestRFC6979Vectors(t *testing.T) {
+	const (
+		p256Key = "C9AFA9D845BA75166B5C215767B1D6934E50C3DB36E89B127B8A622B120F6721"
+		p384Key = "6B9D3DAD2E1B8C1C05B19875B6659F4DE23C3B667BF297BA9AA47740787137D896D5724E4C70A825F872C9EA60D2EDF5"
+	)
+	tests := []struct {
+		curve elliptic.Curve
+		key   string
+		hash  crypto.Hash
+		msg   string
+		r, s  string
+	}{
+		{elliptic.P256(), p256Key, crypto.SHA256, "sample",
+			"EFD48B2AACB6A8FD1140DD9CD45E81D69D2C877B56AAF991C34D0EA84EAF3716",
+			"F7CB1C942D657C41D436C7A1B6E29F65F3E900DBB9AFF4064DC4AB2F843ACDA8"},
+		{elliptic.P256(), p256Key, crypto.SHA384, "sample",
+			"0EAFEA039B20E9B42309FB1D89E213057CBF973DC0CFC8F129EDDDC800EF7719",
+			"4861F0491E6998B9455193E34E7B0D284DDD7149A74B95B9261F13ABDE940954"},
+		{elliptic.P256(), p256Key, crypto.SHA256, "test",
+			"F1ABB023518351CD71D881567B1EA663ED3EFCF6C5132B354F28D3B0B7D38367",
+			"019F4113742A2B14BD25926B49C649155F267E60D3814B4C0CC84250E46F0083"},
+		{elliptic.P384(), p384Key, crypto.SHA256, "sample",
+			"21B13D1E013C7FA1392D03C5F99AF8B30C570C6F98D4EA8E354B63A21D3DAA33BDE1E888E63355D92FA2B3C36D8FB2CD",
+			"F3AA443FB107745BF4BD77CB3891674632068A10CA67E3D45DB2266FA7D1FEEBEFDC63ECCD1AC42EC0CB8668A4FA0AB0"},
+		{elliptic.P384(), p384Key, crypto.SHA384, "sample",
+			"94EDBB92A5ECB8AAD4736E56C691916B3F88140666CE9FA73D64C4EA95AD133C81A648152E44ACF96E36DD1E80FABE46",
+			"99EF4AEB15F178CEA1FE40DB2603138F130E740A19624526203B6351D0A3A94FA329C145786E679E7B82C71A38628AC8"},
+		{elliptic.P384(), p384Key, crypto.SHA384, "test",
+			"8203B63D3C853E8D77227FB377BCF7B7B772E97892A80F36AB775D509D7A5FEB0542A7F0812998DA8F1DD3CA3CF023DB",
+			"DDD0760448D42D8A43AF45AF836FCE4DE8BE06B485E9B61B827C2F13173923E06A739F040649A667BF3B828246BAA5A5"},
+	}
+	for _, tt := range tests {
+		name := tt.curve.Params().Name + " " + tt.hash.String() + " " + tt.msg
+		d := hexInt(t, tt.key)
+		key := &ecdsa.PrivateKey{D: d}
+		key.Curve = tt.curve
+		key.X, key.Y = tt.curve.ScalarBaseMult(d.Bytes())
+		h := tt.hash.New()
+		h.Write([]byte(tt.msg))
+		digest := h.Sum(nil)
+		n := tt.curve.Params().N
+
+		sig, err := deterministicECDSASigner{key}.Sign(nil, digest, tt.hash)
+		if err != nil {
+			t.Fatalf("%s: %s", name, err)
+		}
+		var got struct{ R, S *big.Int }
+		if _, err := asn1.Unmarshal(sig, &got); err != nil {
+			t.Fatalf("%s: %s", name, err)
+		}
+		// The signer normalizes s to the lower half of the order.
+		wantS := hexInt(t, tt.s)
+		if wantS.Cmp(new(big.Int).Rsh(n, 1)) > 0 {
+			wantS.Sub(n, wantS)
+		}
+		if got.R.Cmp(hexInt(t, tt.r)) != 0 || got.S.Cmp(wantS) != 0 {
+			t.Errorf("%s: signature (%X, %X), want (%s, %X)", name, got.R, got.S, tt.r, wantS)
+		}
+		if !ecdsa.Verify(&key.PublicKey, digest, got.R, got.S) {
+			t.Errorf("%s: signature doesn't verify", name)
+		}
+	}
+}
@@ -0,0 +1,223 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"fmt"
+	"math/big"
+)
+
+// secp256k1 leaf keys for -ecdsa-curve secp256k1. crypto/x509 refuses the
+// curve everywhere, so keys are encoded in PKCS #8 and SubjectPublicKeyInfo
+// by hand, and certificates are created for a placeholder key whose
+// SubjectPublicKeyInfo is then replaced before signing again. TLS stacks
+// don't accept secp256k1 certificates; they're for custom protocols. CA
+// keys and self-signed certificates can't use the curve, since crypto/x509
+// can't sign with it.
+
+var oidNamedCurveSecp256k1 = asn1.ObjectIdentifier{1, 3, 132, 0, 10}
+
+// isSecp256k1 reports whether key is a secp256k1 public or private key.
+func isSecp256k1(key interface{}) bool {
+	var curve elliptic.Curve
+	switch k := key.(type) {
+	case *ecdsa.PublicKey:
+		curve = k.Curve
+	case *ecdsa.PrivateKey:
+		curve = k.Curve
+	}
+	return curve != nil && curve == secp256k1Curve
+}
+
+// checkSigningKeyType refuses key types that can't sign certificates, for
+// a key that will sign its own certificate or others.
+func checkSigningKeyType(kt keyType) error {
+	if kt.algorithm == "ecdsa" && kt.curve == "secp256k1" {
+		return usageErrorf("secp256k1 keys can only be used for leaf certificates signed by a CA with another key type, as crypto/x509 can't sign with them")
+	}
+	return nil
+}
+
+type ecPrivateKey struct {
+	Version    int
+	PrivateKey []byte
+	PublicKey  asn1.BitString `asn1:"optional,explicit,tag:1"`
+}
+
+type pkcs8PrivateKey struct {
+	Version    int
+	Algorithm  pkix.AlgorithmIdentifier
+	PrivateKey []byte
+}
+
+func secp256k1Algorithm() (pkix.AlgorithmIdentifier, error) {
+	params, err := asn1.Marshal(oidNamedCurveSecp256k1)
+	if err != nil {
+		return pkix.AlgorithmIdentifier{}, err
+	}
+	return pkix.AlgorithmIdentifier{Algorithm: oidPublicKeyECDSA, Parameters: asn1.RawValue{FullBytes: params}}, nil
+}
+
+// secp256k1Point encodes the public key as an uncompressed point.
+func secp256k1Point(key *ecdsa.PublicKey) asn1.BitString {
+	point := make([]byte, 65)
+	point[0] = 4
+	key.X.FillBytes(point[1:33])
+	key.Y.FillBytes(point[33:])
+	return asn1.BitString{Bytes: point, BitLength: 8 * len(point)}
+}
+
+// marshalPKIXPublicKey is x509.MarshalPKIXPublicKey, also accepting
+// secp256k1 keys.
+func marshalPKIXPublicKey(pub interface{}) ([]byte, error) {
+	if !isSecp256k1(pub) {
+		return x509.MarshalPKIXPublicKey(pub)
+	}
+	alg, err := secp256k1Algorithm()
+	if err != nil {
+		return nil, err
+	}
+	return asn1.Marshal(subjectPublicKeyInfo{Algorithm: alg, PublicKey: secp256k1Point(pub.(*ecdsa.PublicKey))})
+}
+
+// marshalPKCS8PrivateKey is x509.MarshalPKCS8PrivateKey, also accepting
+// secp256k1 keys.
+func marshalPKCS8PrivateKey(key interface{}) ([]byte, error) {
+	if !isSecp256k1(key) {
+		return x509.MarshalPKCS8PrivateKey(key)
+	}
+	k := key.(*ecdsa.PrivateKey)
+	alg, err := secp256k1Algorithm()
+	if err != nil {
+		return nil, err
+	}
+	ecKey, err := asn1.Marshal(ecPrivateKey{
+		Version:    1,
+		PrivateKey: k.D.FillBytes(make([]byte, 32)),
+		PublicKey:  secp256k1Point(&k.PublicKey),
+	})
+	if err != nil {
+		return nil, err
+	}
+	return asn1.Marshal(pkcs8PrivateKey{Algorithm: alg, PrivateKey: ecKey})
+}
+
+// parsePKCS8PrivateKey is x509.ParsePKCS8PrivateKey, also accepting
+// secp256k1 keys.
+func parsePKCS8PrivateKey(der []byte) (interface{}, error) {
+	key, err := x509.ParsePKCS8PrivateKey(der)
+	if err == nil {
+		return key, nil
+	}
+	var p8 pkcs8PrivateKey
+	var curveOID asn1.ObjectIdentifier
+	if _, err2 := asn1.Unmarshal(der, &p8); err2 != nil || !p8.Algorithm.Algorithm.Equal(oidPublicKeyECDSA) {
+		return nil, err
+	} else if _, err2 := asn1.Unmarshal(p8.Algorithm.Parameters.FullBytes, &curveOID); err2 != nil || !curveOID.Equal(oidNamedCurveSecp256k1) {
+		return nil, err
+	}
+	if secp256k1Curve == nil {
+		return nil, fmt.Errorf("the key is secp256k1, but microca was built without secp256k1 support")
+	}
+	var ecKey ecPrivateKey
+	if _, err := asn1.Unmarshal(p8.PrivateKey, &ecKey); err != nil {
+		return nil, fmt.Errorf("parsing secp256k1 private key: %s", err)
+	}
+	d := new(big.Int).SetBytes(ecKey.PrivateKey)
+	if d.Sign() == 0 || d.Cmp(secp256k1Curve.Params().N) >= 0 {
+		return nil, fmt.Errorf("invalid secp256k1 private key")
+	}
+	k := &ecdsa.PrivateKey{D: d}
+	k.Curve = secp256k1Curve
+	k.X, k.Y = secp256k1Curve.ScalarBaseMult(ecKey.PrivateKey)
+	return k, nil
+}
+
+// placeholderPublicKey returns a P-256 public key standing in for a
+// secp256k1 key while crypto/x509 creates or parses a certificate.
+func placeholderPublicKey() *ecdsa.PublicKey {
+	p := elliptic.P256().Params()
+	return &ecdsa.PublicKey{Curve: elliptic.P256(), X: p.Gx, Y: p.Gy}
+}
+
+// createCertificate is x509.CreateCertificate, also accepting a secp256k1
+// public key for the new certificate.
+func createCertificate(template, parent *x509.Certificate, pub, priv interface{}) ([]byte, error) {
+	if !isSecp256k1(pub) {
+		return x509.CreateCertificate(signingRandom(), template, parent, pub, priv)
+	}
+	spki, err := marshalPKIXPublicKey(pub)
+	if err != nil {
+		return nil, err
+	}
+	der, err := x509.CreateCertificate(signingRandom(), template, parent, placeholderPublicKey(), priv)
+	if err != nil {
+		return nil, err
+	}
+	return resignCertificate(der, priv, func(tbs []asn1.RawValue) []asn1.RawValue {
+		tbs[spkiIndex] = asn1.RawValue{FullBytes: spki}
+		return tbs
+	})
+}
+
+// parseSecp256k1Cert parses a DER certificate with a secp256k1 public key,
+// returning nil if it doesn't have one. The fields are read with the key
+// replaced by a placeholder, then the raw encodings and the key are set
+// back, so Raw and the signature are those of der.
+func parseSecp256k1Cert(der []byte) *x509.Certificate {
+	if secp256k1Curve == nil {
+		return nil
+	}
+	var certElems, tbsElems []asn1.RawValue
+	if _, err := asn1.Unmarshal(der, &certElems); err != nil || len(certElems) != 3 {
+		return nil
+	}
+	if _, err := asn1.Unmarshal(certElems[0].FullBytes, &tbsElems); err != nil || len(tbsElems) <= spkiIndex {
+		return nil
+	}
+	i := spkiIndex
+	if tbsElems[0].Class != asn1.ClassContextSpecific || tbsElems[0].Tag != 0 {
+		// A version 1 certificate, without the version.
+		i--
+	}
+	spkiDER := tbsElems[i].FullBytes
+	var spki subjectPublicKeyInfo
+	var curveOID asn1.ObjectIdentifier
+	if _, err := asn1.Unmarshal(spkiDER, &spki); err != nil || !spki.Algorithm.Algorithm.Equal(oidPublicKeyECDSA) {
+		return nil
+	} else if _, err := asn1.Unmarshal(spki.Algorithm.Parameters.FullBytes, &curveOID); err != nil || !curveOID.Equal(oidNamedCurveSecp256k1) {
+		return nil
+	}
+	point := spki.PublicKey.RightAlign()
+	if len(point) != 65 || point[0] != 4 {
+		return nil
+	}
+	pub := &ecdsa.PublicKey{Curve: secp256k1Curve, X: new(big.Int).SetBytes(point[1:33]), Y: new(big.Int).SetBytes(point[33:])}
+	if !secp256k1Curve.IsOnCurve(pub.X, pub.Y) {
+		return nil
+	}
+	placeholder, err := x509.MarshalPKIXPublicKey(placeholderPublicKey())
+	if err != nil {
+		return nil
+	}
+	tbsElems[i] = asn1.RawValue{FullBytes: placeholder}
+	tbs, err := asn1.Marshal(tbsElems)
+	if err != nil {
+		return nil
+	}
+	certElems[0] = asn1.RawValue{FullBytes: tbs}
+	modified, err := asn1.Marshal(certElems)
+	if err != nil {
+		return nil
+	}
+	cert, err := x509.ParseCertificate(modified)
+	if err != nil {
+		return nil
+	}
+	restoreRaw(cert, der)
+	cert.PublicKey = pub
+	return cert
+}
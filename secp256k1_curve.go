@@ -0,0 +1,15 @@
+//go:build !nosecp256k1
+// +build !nosecp256k1
+
+package main
+
+import (
+	"crypto/elliptic"
+
+	"github.com/decred/dcrd/dcrec/secp256k1/v4"
+)
+
+// secp256k1Curve implements secp256k1 for -ecdsa-curve secp256k1, which
+// crypto/elliptic doesn't. Build with the nosecp256k1 tag to leave out the
+// dependency.
+var secp256k1Curve elliptic.Curve = secp256k1.S256()
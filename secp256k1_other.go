@@ -0,0 +1,10 @@
+//go:build nosecp256k1
+// +build nosecp256k1
+
+package main
+
+import "crypto/elliptic"
+
+// secp256k1Curve is nil when built with the nosecp256k1 tag, and
+// -ecdsa-curve secp256k1 is refused.
+var secp256k1Curve elliptic.Curve
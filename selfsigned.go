@@ -0,0 +1,111 @@
+package main
+
+import (
+	"context"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// selfSign generates a key and a self-signed end-entity certificate for
+// spec, for -self-signed. No CA is read or created: the certificate is its
+// own issuer, so clients must be told to trust it some other way.
+func selfSign(ctx context.Context, spec *leafSpec) error {
+	parsedIPs, err := parseIPs(spec.ipAddresses)
+	if err != nil {
+		return err
+	}
+	if !noSAN {
+		if err := checkSANCount(spec.domains, parsedIPs); err != nil {
+			return err
+		}
+	}
+	kt := spec.newKeyType()
+	if err := checkSigningKeyType(kt); err != nil {
+		return err
+	}
+	for _, a := range signatureAlgorithms {
+		// The new key signs its own certificate.
+		if a.alg == signatureAlgorithm && !strings.EqualFold(a.keyType, kt.algorithm) {
+			return usageErrorf("-signature-algorithm %s needs an %s key, but the new key is %s", a.name, a.keyType, describeNewKey(kt))
+		}
+	}
+	cn, cnFolder, err := leafFolder(spec)
+	if err != nil {
+		return err
+	}
+	keyPath := filepath.Join(cnFolder, leafKeyName())
+	certPath := filepath.Join(cnFolder, leafCertName())
+	key, err := makeKey(ctx, keyPath, leafKeyPassword, keyRecipients, kt)
+	if err != nil {
+		removeLeafFolder(cnFolder)
+		return err
+	}
+	pubKey := publicKey(key)
+	serial, err := randomSerial()
+	if err != nil {
+		return err
+	}
+	notBefore, notAfter := leafValidity(now(), spec.validity)
+	template := &x509.Certificate{
+		Subject:               leafSubject(cn),
+		RawSubject:            subjectDN,
+		SerialNumber:          serial,
+		NotBefore:             notBefore,
+		NotAfter:              notAfter,
+		KeyUsage:              x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  false,
+		SignatureAlgorithm:    signatureAlgorithm,
+	}
+	if !noSAN {
+		template.DNSNames = spec.domains
+		template.IPAddresses = parsedIPs
+	}
+	if _, ok := pubKey.(*rsa.PublicKey); ok && !noKeyEncipherment {
+		template.KeyUsage |= x509.KeyUsageKeyEncipherment
+	}
+	der, err := x509.CreateCertificate(signingRandom(), template, template, pubKey, certSigner(key))
+	if err != nil {
+		return err
+	}
+	if postVerify {
+		parent, err := x509.ParseCertificate(der)
+		if err == nil {
+			err = verifyIssued(der, parent)
+		}
+		if err != nil {
+			os.Remove(keyPath)
+			removeLeafFolder(cnFolder)
+			return err
+		}
+	}
+	err = writePEM(certPath, &pem.Block{
+		Type:  "CERTIFICATE",
+		Bytes: der,
+	})
+	if err != nil {
+		return err
+	}
+	out := os.Stdout
+	if quiet {
+		out = os.Stderr
+	}
+	fmt.Fprintf(out, "key: %s\n", keyPath)
+	fmt.Fprintf(out, "cert: %s (self-signed)\n", certPath)
+	spec.certPath, spec.keyPath = certPath, keyPath
+	if auditLogPath != "" {
+		if err := audit(template, pubKey, nil, der); err != nil {
+			return fmt.Errorf("%s was issued, but writing the audit log failed: %s", certPath, err)
+		}
+	}
+	if postHook != "" {
+		return runPostHook(certPath, keyPath, append(append([]string(nil), spec.domains...), spec.ipAddresses...))
+	}
+	return nil
+}
@@ -0,0 +1,30 @@
+package main
+
+import (
+	"crypto/tls"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+)
+
+// serve runs an HTTPS server on addr using the leaf certificate just issued
+// for spec, answering every request with the certificate's names. It only
+// returns on error.
+func serve(addr string, spec *leafSpec, iss *issuer) error {
+	cert, err := tls.LoadX509KeyPair(spec.certPath, spec.keyPath)
+	if err != nil {
+		return fmt.Errorf("loading %s for -serve: %s", spec.certPath, err)
+	}
+	cert.Certificate = append(cert.Certificate, iss.cert.Raw)
+	names := strings.Join(append(append([]string(nil), spec.domains...), spec.ipAddresses...), ", ")
+	server := &http.Server{
+		Addr:      addr,
+		TLSConfig: &tls.Config{Certificates: []tls.Certificate{cert}},
+		Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			fmt.Fprintf(w, "Hello from microca\nSANs: %s\n", names)
+		}),
+	}
+	log.Printf("serving %s on https://%s until interrupted", spec.certPath, addr)
+	return server.ListenAndServeTLS("", "")
+}
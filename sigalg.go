@@ -0,0 +1,99 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/rsa"
+	"crypto/x509"
+	"strings"
+)
+
+// signatureAlgorithms lists the values accepted by -signature-algorithm,
+// with the type of CA key each needs.
+var signatureAlgorithms = []struct {
+	name    string // as the crypto/x509 constant
+	alg     x509.SignatureAlgorithm
+	keyType string
+}{
+	{"SHA256WithRSA", x509.SHA256WithRSA, "RSA"},
+	{"SHA384WithRSA", x509.SHA384WithRSA, "RSA"},
+	{"SHA512WithRSA", x509.SHA512WithRSA, "RSA"},
+	{"SHA256WithRSAPSS", x509.SHA256WithRSAPSS, "RSA"},
+	{"SHA384WithRSAPSS", x509.SHA384WithRSAPSS, "RSA"},
+	{"SHA512WithRSAPSS", x509.SHA512WithRSAPSS, "RSA"},
+	{"ECDSAWithSHA256", x509.ECDSAWithSHA256, "ECDSA"},
+	{"ECDSAWithSHA384", x509.ECDSAWithSHA384, "ECDSA"},
+	{"ECDSAWithSHA512", x509.ECDSAWithSHA512, "ECDSA"},
+	{"PureEd25519", x509.PureEd25519, "Ed25519"},
+}
+
+// parseSignatureAlgorithm parses a -signature-algorithm value, either the
+// crypto/x509 constant name such as ECDSAWithSHA384 or the name it prints,
+// such as ECDSA-SHA384.
+func parseSignatureAlgorithm(s string) (x509.SignatureAlgorithm, error) {
+	var names []string
+	for _, a := range signatureAlgorithms {
+		if strings.EqualFold(s, a.name) || strings.EqualFold(s, a.alg.String()) {
+			return a.alg, nil
+		}
+		names = append(names, a.name)
+	}
+	return 0, usageErrorf("unrecognized -signature-algorithm %q, expected one of %s", s, strings.Join(names, ", "))
+}
+
+// checkSignatureAlgorithm makes sure the CA key can make signatures of
+// type alg, which crypto/x509 would otherwise only report vaguely.
+func checkSignatureAlgorithm(alg x509.SignatureAlgorithm, caKey interface{}) error {
+	var have string
+	switch publicKey(caKey).(type) {
+	case *rsa.PublicKey:
+		have = "RSA"
+	case *ecdsa.PublicKey:
+		have = "ECDSA"
+	case ed25519.PublicKey:
+		have = "Ed25519"
+	}
+	for _, a := range signatureAlgorithms {
+		if a.alg == alg && a.keyType != have {
+			return usageErrorf("-signature-algorithm %s needs an %s CA key, but the CA key is %s",
+				a.name, a.keyType, keyDescription(publicKey(caKey)))
+		}
+	}
+	return nil
+}
+
+// leafSignatureAlgorithm returns the algorithm leaf certificates are signed
+// with by a CA whose key is of type kt: -signature-algorithm if set, or the
+// one crypto/x509 picks for the key. It depends only on the CA key, never on
+// the leaf key, so an ECDSA leaf from an RSA CA has an RSA signature.
+func leafSignatureAlgorithm(kt keyType) x509.SignatureAlgorithm {
+	if signatureAlgorithm != x509.UnknownSignatureAlgorithm {
+		return signatureAlgorithm
+	}
+	switch kt.algorithm {
+	case "rsa":
+		return x509.SHA256WithRSA
+	case "ed25519":
+		return x509.PureEd25519
+	}
+	switch kt.curve {
+	case "P384":
+		return x509.ECDSAWithSHA384
+	case "P521":
+		return x509.ECDSAWithSHA512
+	}
+	return x509.ECDSAWithSHA256
+}
+
+// publicKeyType returns the keyType of an existing public key.
+func publicKeyType(pub interface{}) keyType {
+	switch pub := pub.(type) {
+	case *rsa.PublicKey:
+		return keyType{algorithm: "rsa", rsaBits: pub.N.BitLen()}
+	case ed25519.PublicKey:
+		return keyType{algorithm: "ed25519"}
+	case *ecdsa.PublicKey:
+		return keyType{algorithm: "ecdsa", curve: strings.Replace(pub.Curve.Params().Name, "-", "", 1)}
+	}
+	return keyType{}
+}
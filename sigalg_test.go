@@ -0,0 +1,145 @@
+package main
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestSignatureAlgorithmPairings(t *testing.T) {
+	defer func(old x509.SignatureAlgorithm) { signatureAlgorithm = old }(signatureAlgorithm)
+	defer func(old string) { outputDir = old }(outputDir)
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, edKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ecKey := testKey(t)
+	cas := []struct {
+		keyType string
+		iss     *issuer
+	}{
+		{"RSA", &issuer{rsaKey, testCA(t, "RSA CA", -1, rsaKey, nil, nil)}},
+		{"ECDSA", &issuer{ecKey, testCA(t, "ECDSA CA", -1, ecKey, nil, nil)}},
+		{"Ed25519", &issuer{edKey, testCA(t, "Ed25519 CA", -1, edKey, nil, nil)}},
+	}
+	for _, a := range signatureAlgorithms {
+		for _, ca := range cas {
+			compatible := a.keyType == ca.keyType
+			err := checkSignatureAlgorithm(a.alg, ca.iss.key)
+			if (err == nil) != compatible {
+				t.Errorf("%s with a %s CA: got error %v, want ok %t", a.name, ca.keyType, err, compatible)
+			}
+
+			signatureAlgorithm = a.alg
+			outputDir = t.TempDir()
+			cert, err := sign(context.Background(), ca.iss, &leafSpec{domains: []string{"sigalg.example"}, keyType: &keyType{algorithm: "ed25519"}})
+			if !compatible {
+				if err == nil {
+					t.Errorf("%s with a %s CA: issued", a.name, ca.keyType)
+				} else if _, err := os.Stat(filepath.Join(outputDir, "sigalg.example")); !os.IsNotExist(err) {
+					t.Errorf("%s with a %s CA: leaf folder created before refusing", a.name, ca.keyType)
+				}
+			} else if err != nil {
+				t.Errorf("%s with a %s CA: %s", a.name, ca.keyType, err)
+			} else if cert.SignatureAlgorithm != a.alg {
+				t.Errorf("%s with a %s CA: leaf signed with %s", a.name, ca.keyType, cert.SignatureAlgorithm)
+			}
+		}
+	}
+}
+
+// The leaf's signature algorithm follows the CA key, never the leaf key.
+func TestMixedKeySignatureAlgorithm(t *testing.T) {
+	defer func(old x509.SignatureAlgorithm) { signatureAlgorithm = old }(signatureAlgorithm)
+	signatureAlgorithm = x509.UnknownSignatureAlgorithm
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p384Key, err := ecdsa.GenerateKey(elliptic.P384(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		caKey   crypto.Signer
+		leaf    keyType
+		wantSig x509.SignatureAlgorithm
+		wantKey x509.PublicKeyAlgorithm
+	}{
+		{rsaKey, keyType{algorithm: "ecdsa", curve: "P256"}, x509.SHA256WithRSA, x509.ECDSA},
+		{rsaKey, keyType{algorithm: "ed25519"}, x509.SHA256WithRSA, x509.Ed25519},
+		{testKey(t), keyType{algorithm: "rsa", rsaBits: 2048}, x509.ECDSAWithSHA256, x509.RSA},
+		{p384Key, keyType{algorithm: "rsa", rsaBits: 2048}, x509.ECDSAWithSHA384, x509.RSA},
+	}
+	for _, tt := range tests {
+		iss := &issuer{tt.caKey, testCA(t, "mixed CA", -1, tt.caKey, nil, nil)}
+		leaf := tt.leaf
+		cert, err := testSign(t, iss, &leafSpec{domains: []string{"mixed.example"}, keyType: &leaf})
+		if err != nil {
+			t.Fatal(err)
+		}
+		name := keyDescription(tt.caKey.Public()) + " CA, " + describeNewKey(leaf) + " leaf"
+		if cert.SignatureAlgorithm != tt.wantSig {
+			t.Errorf("%s: signed with %s, want %s", name, cert.SignatureAlgorithm, tt.wantSig)
+		}
+		if want := leafSignatureAlgorithm(publicKeyType(tt.caKey.Public())); cert.SignatureAlgorithm != want {
+			t.Errorf("%s: signed with %s, but leafSignatureAlgorithm reports %s", name, cert.SignatureAlgorithm, want)
+		}
+		if cert.PublicKeyAlgorithm != tt.wantKey {
+			t.Errorf("%s: public key is %s, want %s", name, cert.PublicKeyAlgorithm, tt.wantKey)
+		}
+		if err := cert.CheckSignatureFrom(iss.cert); err != nil {
+			t.Errorf("%s: %s", name, err)
+		}
+	}
+}
+
+// Certificates signed again after crypto/x509, to add unique identifiers,
+// keep a valid signature with every algorithm, RSA-PSS included.
+func TestResignSignatureAlgorithms(t *testing.T) {
+	defer func(old x509.SignatureAlgorithm) { signatureAlgorithm = old }(signatureAlgorithm)
+	defer func(old []byte) { issuerUniqueID = old }(issuerUniqueID)
+	defer func(old []byte) { subjectUniqueID = old }(subjectUniqueID)
+	issuerUniqueID, subjectUniqueID = []byte{1, 2}, []byte{3, 4}
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, edKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ecKey := testKey(t)
+	cas := map[string]*issuer{
+		"RSA":     {rsaKey, testCA(t, "RSA CA", -1, rsaKey, nil, nil)},
+		"ECDSA":   {ecKey, testCA(t, "ECDSA CA", -1, ecKey, nil, nil)},
+		"Ed25519": {edKey, testCA(t, "Ed25519 CA", -1, edKey, nil, nil)},
+	}
+	for _, a := range signatureAlgorithms {
+		signatureAlgorithm = a.alg
+		iss := cas[a.keyType]
+		cert, err := testSign(t, iss, &leafSpec{domains: []string{"resign.example"}})
+		if err != nil {
+			t.Errorf("%s: %s", a.name, err)
+			continue
+		}
+		if cert.SignatureAlgorithm != a.alg {
+			t.Errorf("%s: leaf signed with %s", a.name, cert.SignatureAlgorithm)
+		}
+		if err := cert.CheckSignatureFrom(iss.cert); err != nil {
+			t.Errorf("%s: %s", a.name, err)
+		}
+	}
+}
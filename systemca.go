@@ -0,0 +1,105 @@
+package main
+
+import (
+	"crypto/x509"
+	"encoding/pem"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// systemPrefix marks a -ca-cert to be found by subject in the system trust
+// store, as set by -ca-from-system.
+const systemPrefix = "system:"
+
+// PEM bundles and folders holding the system trust store on common Unix
+// systems, as searched by crypto/x509. $SSL_CERT_FILE and $SSL_CERT_DIR
+// replace them, as they do for crypto/x509.
+var (
+	systemCertFiles = []string{
+		"/etc/ssl/certs/ca-certificates.crt",
+		"/etc/pki/tls/certs/ca-bundle.crt",
+		"/etc/ssl/ca-bundle.pem",
+		"/etc/pki/tls/cacert.pem",
+		"/etc/pki/ca-trust/extracted/pem/tls-ca-bundle.pem",
+		"/etc/ssl/cert.pem",
+	}
+	systemCertDirs = []string{
+		"/etc/ssl/certs",
+		"/etc/pki/tls/certs",
+	}
+)
+
+// findSystemCA returns the PEM encoded CA certificate from the system trust
+// store whose subject contains substring, ignoring case. It fails unless
+// exactly one certificate matches. Stores that aren't PEM files, as on macOS
+// and Windows, can't be searched.
+func findSystemCA(substring string) ([]byte, error) {
+	files, dirs := systemCertFiles, systemCertDirs
+	if f := os.Getenv("SSL_CERT_FILE"); f != "" {
+		files = []string{f}
+	}
+	if d := os.Getenv("SSL_CERT_DIR"); d != "" {
+		dirs = filepath.SplitList(d)
+	}
+	for _, dir := range dirs {
+		entries, err := ioutil.ReadDir(dir)
+		if err != nil {
+			continue
+		}
+		for _, e := range entries {
+			files = append(files, filepath.Join(dir, e.Name()))
+		}
+	}
+
+	var matches []*x509.Certificate
+	searched := false
+	for _, file := range files {
+		contents, err := ioutil.ReadFile(file)
+		if err != nil {
+			continue
+		}
+		searched = true
+		for {
+			var block *pem.Block
+			block, contents = pem.Decode(contents)
+			if block == nil {
+				break
+			}
+			if block.Type != "CERTIFICATE" {
+				continue
+			}
+			cert, err := x509.ParseCertificate(block.Bytes)
+			if err != nil || !cert.IsCA {
+				continue
+			}
+			if !strings.Contains(strings.ToLower(cert.Subject.String()), strings.ToLower(substring)) {
+				continue
+			}
+			duplicate := false
+			for _, m := range matches {
+				if m.Equal(cert) {
+					duplicate = true
+				}
+			}
+			if !duplicate {
+				matches = append(matches, cert)
+			}
+		}
+	}
+	if !searched {
+		return nil, caErrorf("no system trust store found; -ca-from-system only reads the PEM stores of Unix systems, set $SSL_CERT_FILE or $SSL_CERT_DIR to point at one")
+	}
+	switch len(matches) {
+	case 0:
+		return nil, caErrorf("no CA certificate in the system trust store has a subject containing %q", substring)
+	case 1:
+		return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: matches[0].Raw}), nil
+	}
+	var subjects []string
+	for _, m := range matches {
+		subjects = append(subjects, m.Subject.String())
+	}
+	return nil, caErrorf("%d CA certificates in the system trust store match %q: %s", len(matches), substring, strings.Join(subjects, "; "))
+}
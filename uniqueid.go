@@ -0,0 +1,127 @@
+package main
+
+import (
+	"crypto"
+	"crypto/rsa"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/hex"
+	"fmt"
+)
+
+// X.509 v2 issuerUniqueID and subjectUniqueID (RFC 5280, section 4.1.2.8).
+// RFC 5280 says CAs must not generate them and they're almost never needed,
+// but they're useful for exhaustive interop test vectors. crypto/x509 can't
+// set them, so they're spliced into the signed certificate, which is then
+// signed again.
+
+type certificateASN1 struct {
+	TBSCertificate     asn1.RawValue
+	SignatureAlgorithm pkix.AlgorithmIdentifier
+	SignatureValue     asn1.BitString
+}
+
+// parseUniqueID parses a hex encoded unique identifier, returning nil if s
+// is empty.
+func parseUniqueID(s string) ([]byte, error) {
+	if s == "" {
+		return nil, nil
+	}
+	id, err := hex.DecodeString(s)
+	if err != nil || len(id) == 0 {
+		return nil, usageErrorf("invalid unique identifier %q, expected hex", s)
+	}
+	return id, nil
+}
+
+// signatureOpts returns the signer options for a signature algorithm
+// crypto/x509 may choose when signing a certificate. RSA-PSS salts are as
+// long as the hash, as crypto/x509 makes them.
+func signatureOpts(alg x509.SignatureAlgorithm) (crypto.SignerOpts, error) {
+	switch alg {
+	case x509.SHA256WithRSA, x509.ECDSAWithSHA256:
+		return crypto.SHA256, nil
+	case x509.SHA384WithRSA, x509.ECDSAWithSHA384:
+		return crypto.SHA384, nil
+	case x509.SHA512WithRSA, x509.ECDSAWithSHA512:
+		return crypto.SHA512, nil
+	case x509.SHA256WithRSAPSS:
+		return &rsa.PSSOptions{SaltLength: rsa.PSSSaltLengthEqualsHash, Hash: crypto.SHA256}, nil
+	case x509.SHA384WithRSAPSS:
+		return &rsa.PSSOptions{SaltLength: rsa.PSSSaltLengthEqualsHash, Hash: crypto.SHA384}, nil
+	case x509.SHA512WithRSAPSS:
+		return &rsa.PSSOptions{SaltLength: rsa.PSSSaltLengthEqualsHash, Hash: crypto.SHA512}, nil
+	case x509.PureEd25519:
+		return crypto.Hash(0), nil
+	}
+	return nil, fmt.Errorf("can't re-sign a certificate using %s", alg)
+}
+
+// addUniqueIDs inserts the given issuer and subject unique identifiers into
+// the DER certificate der and signs it again with key.
+func addUniqueIDs(der, issuerID, subjectID []byte, key interface{}) ([]byte, error) {
+	var ids []asn1.RawValue
+	if issuerID != nil {
+		ids = append(ids, asn1.RawValue{Class: asn1.ClassContextSpecific, Tag: 1, Bytes: append([]byte{0}, issuerID...)})
+	}
+	if subjectID != nil {
+		ids = append(ids, asn1.RawValue{Class: asn1.ClassContextSpecific, Tag: 2, Bytes: append([]byte{0}, subjectID...)})
+	}
+	return resignCertificate(der, key, func(tbs []asn1.RawValue) []asn1.RawValue {
+		return append(tbs[:spkiIndex+1], append(ids, tbs[spkiIndex+1:]...)...)
+	})
+}
+
+// spkiIndex is the position of subjectPublicKeyInfo in a version 3
+// TBSCertificate, after the version, serialNumber, signature, issuer,
+// validity and subject. The unique identifiers and extensions follow it.
+const spkiIndex = 6
+
+// resignCertificate passes the elements of the TBSCertificate of the DER
+// certificate der, which must be version 3, to edit and signs the result
+// again with key.
+func resignCertificate(der []byte, key interface{}, edit func(tbs []asn1.RawValue) []asn1.RawValue) ([]byte, error) {
+	signer, ok := key.(crypto.Signer)
+	if !ok {
+		return nil, fmt.Errorf("CA key of type %T can't sign", key)
+	}
+	parsed, err := parseCertDER(der)
+	if err != nil {
+		return nil, err
+	}
+	opts, err := signatureOpts(parsed.SignatureAlgorithm)
+	if err != nil {
+		return nil, err
+	}
+
+	var cert certificateASN1
+	if _, err := asn1.Unmarshal(der, &cert); err != nil {
+		return nil, err
+	}
+	var tbs []asn1.RawValue
+	if _, err := asn1.Unmarshal(cert.TBSCertificate.FullBytes, &tbs); err != nil {
+		return nil, err
+	}
+	if len(tbs) <= spkiIndex || tbs[0].Class != asn1.ClassContextSpecific || tbs[0].Tag != 0 {
+		return nil, fmt.Errorf("unexpected TBSCertificate structure")
+	}
+	tbsDER, err := asn1.Marshal(edit(tbs))
+	if err != nil {
+		return nil, err
+	}
+
+	digest := tbsDER
+	if h := opts.HashFunc(); h != 0 {
+		hh := h.New()
+		hh.Write(tbsDER)
+		digest = hh.Sum(nil)
+	}
+	sig, err := signer.Sign(signingRandom(), digest, opts)
+	if err != nil {
+		return nil, err
+	}
+	cert.TBSCertificate = asn1.RawValue{FullBytes: tbsDER}
+	cert.SignatureValue = asn1.BitString{Bytes: sig, BitLength: 8 * len(sig)}
+	return asn1.Marshal(cert)
+}
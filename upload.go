@@ -0,0 +1,68 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"time"
+)
+
+// uploadPayload is the JSON body posted by -upload-url, shaped like a Vault
+// KV version 2 secret write: the fields are wrapped in "data". It isn't a
+// Vault PKI request.
+type uploadPayload struct {
+	Data struct {
+		CommonName   string   `json:"common_name"`
+		SerialNumber string   `json:"serial_number"`
+		Certificate  string   `json:"certificate"`
+		PrivateKey   string   `json:"private_key,omitempty"`
+		IssuingCA    string   `json:"issuing_ca"`
+		CAChain      []string `json:"ca_chain"`
+	} `json:"data"`
+}
+
+// upload posts the certificate der, the key file at keyPath as written, if
+// there is one, and the CA certificate to uploadURL, authenticated with
+// uploadToken as a bearer token.
+func upload(cn string, der []byte, serial string, keyPath string, iss *issuer) error {
+	var p uploadPayload
+	p.Data.CommonName = cn
+	p.Data.SerialNumber = serial
+	p.Data.Certificate = string(encodePEM(&pem.Block{Type: "CERTIFICATE", Bytes: der}))
+	ca := string(encodePEM(&pem.Block{Type: "CERTIFICATE", Bytes: iss.cert.Raw}))
+	p.Data.IssuingCA = ca
+	p.Data.CAChain = []string{ca}
+	key, err := ioutil.ReadFile(keyPath)
+	if err == nil {
+		p.Data.PrivateKey = string(key)
+	} else if !os.IsNotExist(err) {
+		return err
+	}
+	body, err := json.Marshal(p)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest(http.MethodPost, uploadURL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if uploadToken != "" {
+		req.Header.Set("Authorization", "Bearer "+uploadToken)
+	}
+	client := &http.Client{Timeout: 30 * time.Second}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		respBody, _ := ioutil.ReadAll(resp.Body)
+		return fmt.Errorf("%s: %s %s", uploadURL, resp.Status, bytes.TrimSpace(respBody))
+	}
+	return nil
+}